@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// aclProtocols are the protocols ACL rules can be restricted to, by name
+var aclProtocols = map[string]byte{
+	"tcp":  unix.IPPROTO_TCP,
+	"udp":  unix.IPPROTO_UDP,
+	"icmp": unix.IPPROTO_ICMP,
+}
+
+// verifyACL checks ACL rules, normalizing their destinations and protocols
+func verifyACL(rules []ACLRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(rule.Destination))
+		if err != nil {
+			return fmt.Errorf("invalid ACL destination: %w", err)
+		}
+		rule.Destination = ipNet.String()
+
+		rule.Protocol = strings.ToLower(rule.Protocol)
+		if _, ok := aclProtocols[rule.Protocol]; !ok && rule.Protocol != "" {
+			return fmt.Errorf("invalid ACL protocol: %q", rule.Protocol)
+		}
+
+		if len(rule.Ports) > 0 && rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return fmt.Errorf("ACL ports require tcp or udp")
+		}
+		for _, port := range rule.Ports {
+			if _, _, err := parsePortRange(port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// aclEqual returns whether two lists of ACL rules are the same
+func aclEqual(a []ACLRule, b []ACLRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Destination != b[i].Destination || a[i].Protocol != b[i].Protocol ||
+			strings.Join(a[i].Ports, ",") != strings.Join(b[i].Ports, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePortRange parses a port like 443 or a port range like 8000-8100
+func parsePortRange(port string) (uint16, uint16, error) {
+	from, to := port, port
+	if i := strings.Index(port, "-"); i >= 0 {
+		from, to = port[:i], port[i+1:]
+	}
+
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil || f == 0 {
+		return 0, 0, fmt.Errorf("invalid ACL port: %q", port)
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || t < f {
+		return 0, 0, fmt.Errorf("invalid ACL port: %q", port)
+	}
+	return uint16(f), uint16(t), nil
+}
+
+// applyACLs replaces the firewall rules enforcing the ACLs. Traffic a client with ACL rules, its own or those of its
+// user, sends through the WireGuard device is dropped unless a rule allows it. Traffic of clients without rules is
+// subject to --acl-default-policy.
+func (s *Server) applyACLs() error {
+	users := make([]string, 0, len(s.Config.Users))
+	for user := range s.Config.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var entries []aclEntry
+	var closed []string
+	for _, n := range s.sortedNetworks() {
+		for _, user := range users {
+			cfg := s.Config.Users[user]
+			for id, client := range cfg.Clients {
+				if client.Network != n.name {
+					continue
+				}
+				rules := append(append([]ACLRule{}, cfg.ACL...), client.ACL...)
+				if len(rules) == 0 {
+					continue
+				}
+
+				log.WithFields(log.Fields{"user": user, "client": id, "rules": len(rules)}).Debug("Adding ACL")
+				for _, src := range clientSources(client) {
+					entries = append(entries, aclEntry{Device: n.Device, Source: src, Rules: rules})
+				}
+			}
+		}
+
+		if *aclDefaultPolicy == "drop" {
+			closed = append(closed, n.Device)
+		}
+	}
+
+	return s.firewall.SetACLs(entries, closed)
+}
+
+// clientSources returns the addresses and networks a client may send from through the tunnel: its own addresses and
+// its AllowedIPs, which WireGuard accepts as source addresses as well
+func clientSources(client *ClientConfig) []*net.IPNet {
+	var sources []*net.IPNet
+	for _, ip := range []net.IP{client.IP, client.IPv6} {
+		if ip != nil {
+			sources = append(sources, netlink.NewIPNet(ip))
+		}
+	}
+	for _, cidr := range client.AllowedIPs {
+		if cidr != nil {
+			sources = append(sources, cidr)
+		}
+	}
+	return sources
+}
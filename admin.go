@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// isAdmin returns whether the user of the request may manage the clients of all users
+func isAdmin(r *http.Request) bool {
+	user, _ := r.Context().Value(key).(string)
+	for _, u := range *adminUsers {
+		if u == user {
+			return true
+		}
+	}
+
+	groups, _ := r.Context().Value(groupsKey).([]string)
+	for _, g := range groups {
+		for _, a := range *adminGroups {
+			if g == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) withAdmin(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		log.Debug("Admin required")
+
+		if !isAdmin(r) {
+			log.WithField("user", r.Context().Value(key)).WithField("path", r.URL.Path).Warn("Unauthorized admin access")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		handler(w, r, ps)
+	}
+}
+
+// GetUsers returns all users and their clients
+func (s *Server) GetUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	err := json.NewEncoder(w).Encode(s.Config.Users)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// SetUserACL replaces the ACL rules applying to all clients of a user
+func (s *Server) SetUserACL(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := ps.ByName("user")
+	usercfg := s.Config.Users[user]
+	if usercfg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var rules []ACLRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		log.Warn("Error parsing request: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := verifyACL(rules); err != nil {
+		log.WithField("user", user).Warn("Invalid user ACL: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	log.WithField("user", user).WithField("rules", len(rules)).Info("Setting user ACL")
+	usercfg.ACL = rules
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(usercfg.ACL)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// ipOwner tells which client of which user an IP address is allocated to
+type ipOwner struct {
+	IP      net.IP
+	Network string
+	User    string
+	Client  string
+	Name    string
+}
+
+// GetIPs returns all allocated IP addresses and who owns them, ordered by address
+func (s *Server) GetIPs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	owners := make([]ipOwner, 0)
+	for user, cfg := range s.Config.Users {
+		for id, client := range cfg.Clients {
+			for _, ip := range []net.IP{client.IP, client.IPv6} {
+				if ip == nil {
+					continue
+				}
+				owners = append(owners, ipOwner{
+					IP:      ip,
+					Network: client.Network,
+					User:    user,
+					Client:  id,
+					Name:    client.Name,
+				})
+			}
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i].Network != owners[j].Network {
+			return owners[i].Network < owners[j].Network
+		}
+		return bytes.Compare(owners[i].IP.To16(), owners[j].IP.To16()) < 0
+	})
+
+	err := json.NewEncoder(w).Encode(owners)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// poolRangeUsage tells how many addresses of a pool range are allocated
+type poolRangeUsage struct {
+	Range string
+	Used  int
+	Size  uint64
+}
+
+// poolUsage is a pool with the utilization of its ranges
+type poolUsage struct {
+	Name    string
+	Network string
+	Users   []string
+	Groups  []string
+	Ranges  []poolRangeUsage
+}
+
+// GetPools returns all address pools and how many of their addresses are allocated, ordered by name
+func (s *Server) GetPools(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	pools := make([]poolUsage, 0, len(s.Config.Pools))
+	for name, pool := range s.Config.Pools {
+		usage := poolUsage{
+			Name:    name,
+			Network: pool.network(),
+			Users:   pool.Users,
+			Groups:  pool.Groups,
+		}
+		for _, cidr := range pool.Ranges {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.WithField("pool", name).Warn("Invalid pool range: ", err)
+				continue
+			}
+			usage.Ranges = append(usage.Ranges, poolRangeUsage{
+				Range: cidr,
+				Used:  s.Config.countIPs(pool.network(), ipNet),
+				Size:  rangeSize(ipNet),
+			})
+		}
+		pools = append(pools, usage)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	err := json.NewEncoder(w).Encode(pools)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// rangeSize returns the number of addresses of a range, capped at the largest uint64
+func rangeSize(ipNet *net.IPNet) uint64 {
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << uint(bits-ones)
+}
+
+// SetPool creates or replaces the address pool named in the request
+func (s *Server) SetPool(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := ps.ByName("pool")
+	pool := &PoolConfig{}
+	if err := json.NewDecoder(r.Body).Decode(pool); err != nil {
+		log.Warn("Error parsing request: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verifyPool(name, pool); err != nil {
+		log.WithField("pool", name).Warn("Invalid pool: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if s.Config.Pools == nil {
+		s.Config.Pools = make(map[string]*PoolConfig)
+	}
+	s.Config.Pools[name] = pool
+	s.updatePools()
+	if err := s.Config.Write(); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("pool", name).Info("Saved address pool: ", pool.Ranges)
+	err := json.NewEncoder(w).Encode(pool)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// updatePools hands the pools of each network to its allocator
+func (s *Server) updatePools() {
+	for _, n := range s.networks {
+		n.allocator.setPools(s.Config.poolRanges(n.name))
+	}
+}
+
+// verifyPool checks that a pool has at most one range per IP version, within the client IP range of that version of
+// its network, and that it does not overlap other pools. The ranges are normalized.
+func (s *Server) verifyPool(name string, pool *PoolConfig) error {
+	if name == "" {
+		return fmt.Errorf("pool name is empty")
+	}
+	if len(pool.Ranges) == 0 {
+		return fmt.Errorf("pool has no range")
+	}
+	n := s.networks[pool.network()]
+	if n == nil {
+		return fmt.Errorf("no such network: %s", pool.network())
+	}
+
+	versions := make(map[bool]bool)
+	for i, cidr := range pool.Ranges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		pool.Ranges[i] = ipNet.String()
+
+		ipv6 := ipNet.IP.To4() == nil
+		if versions[ipv6] {
+			return fmt.Errorf("more than one range of the same IP version")
+		}
+		versions[ipv6] = true
+
+		if !n.withinIPRanges(ipNet) {
+			return fmt.Errorf("%s is not within a client IP range of network %s", ipNet, n.name)
+		}
+
+		for other, p := range s.Config.Pools {
+			if other == name || p.network() != n.name {
+				continue
+			}
+			for _, c := range p.Ranges {
+				_, o, err := net.ParseCIDR(c)
+				if err == nil && (o.Contains(ipNet.IP) || ipNet.Contains(o.IP)) {
+					return fmt.Errorf("%s overlaps pool %s", ipNet, other)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DeletePool deletes the address pool named in the request. The addresses of its clients are kept.
+func (s *Server) DeletePool(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := ps.ByName("pool")
+	if s.Config.Pools[name] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	delete(s.Config.Pools, name)
+	s.updatePools()
+	if err := s.Config.Write(); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("pool", name).Info("Deleted address pool")
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetNetwork creates the network named in the request, or changes its listen port, endpoint and allowed IPs. The
+// default network is configured with the command line flags instead.
+func (s *Server) SetNetwork(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := ps.ByName("net")
+	req := &NetworkConfig{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.Warn("Error parsing request: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verifyNetwork(name, req); err != nil {
+		log.WithField("network", name).Warn("Invalid network: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	n := s.networks[name]
+	if n != nil {
+		n.ListenPort = req.ListenPort
+		n.Endpoint = req.Endpoint
+		n.AllowedIPs = req.AllowedIPs
+	} else {
+		cfg, err := newNetworkConfig()
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		cfg.Device = req.Device
+		cfg.ListenPort = req.ListenPort
+		cfg.IPRanges = req.IPRanges
+		cfg.Endpoint = req.Endpoint
+		cfg.AllowedIPs = req.AllowedIPs
+		s.Config.Networks[name] = cfg
+
+		// An existing WireGuard device is reused, and left in place if the network cannot be created
+		_, lerr := netlink.LinkByName(cfg.Device)
+		existed := lerr == nil
+
+		n, err = newNetwork(s.Config, name, s.reserved)
+		if err == nil {
+			if err = s.initNetwork(n); err != nil {
+				s.discardNetwork(n, existed)
+			}
+		}
+		if err == nil {
+			s.networks[name] = n
+			if err = s.enableIPForward(); err == nil {
+				err = s.initNAT()
+			}
+			if err != nil {
+				s.discardNetwork(n, existed)
+			}
+		}
+		if err != nil {
+			log.WithField("network", name).Error("Error creating network: ", err)
+			delete(s.Config.Networks, name)
+			delete(s.networks, name)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("network", name).Infof("Saved network on %s", n.Device)
+	s.writeServerInfo(w, n)
+}
+
+// verifyNetwork checks the settings of a network. The device and IP ranges of a network cannot be changed, and no
+// two networks may share a device or port.
+func (s *Server) verifyNetwork(name string, req *NetworkConfig) error {
+	if name == "" {
+		return fmt.Errorf("network name is empty")
+	}
+	if name == defaultNetwork {
+		return fmt.Errorf("the default network is configured with command line flags")
+	}
+	if req.Device == "" || len(req.Device) > 15 {
+		return fmt.Errorf("device name must be 1 to 15 characters long")
+	}
+	if req.ListenPort <= 0 || req.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port: %d", req.ListenPort)
+	}
+	if req.Endpoint == "" {
+		return fmt.Errorf("endpoint is empty")
+	}
+	if len(req.AllowedIPs) == 0 {
+		req.AllowedIPs = []string{"0.0.0.0/0"}
+	}
+	for _, cidr := range req.AllowedIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+
+	if n := s.networks[name]; n != nil {
+		if req.Device != n.Device || strings.Join(req.IPRanges, ",") != strings.Join(n.IPRanges, ",") {
+			return fmt.Errorf("the device and IP ranges of a network cannot be changed")
+		}
+	} else {
+		ranges, err := parseIPRanges(req.IPRanges)
+		if err != nil {
+			return err
+		}
+		if err := s.verifyRangesFree(ranges); err != nil {
+			return err
+		}
+		// An existing WireGuard device is reused, other links must not be taken over, and later deleted, by wg-ui
+		if link, err := netlink.LinkByName(req.Device); err == nil && link.Type() != "wireguard" {
+			return fmt.Errorf("device %s exists and is not a WireGuard device", req.Device)
+		}
+	}
+
+	for other, n := range s.networks {
+		if other == name {
+			continue
+		}
+		if n.Device == req.Device {
+			return fmt.Errorf("device %s is used by network %s", req.Device, other)
+		}
+		if n.ListenPort == req.ListenPort {
+			return fmt.Errorf("port %d is used by network %s", req.ListenPort, other)
+		}
+	}
+	return nil
+}
+
+// verifyRangesFree checks that the client IP ranges of a new network overlap neither those of the other networks nor
+// the reserved ranges, so that an address, and the routes to it, belong to a single network
+func (s *Server) verifyRangesFree(ranges []ipRange) error {
+	for _, r := range ranges {
+		for other, n := range s.networks {
+			for _, o := range n.ipRanges {
+				if r.Contains(o.IP) || o.Contains(r.IP) {
+					return fmt.Errorf("client IP range %s overlaps %s of network %s", r.cidr, o.cidr, other)
+				}
+			}
+		}
+		for _, reserved := range s.reserved {
+			if r.Contains(reserved.IP) || reserved.Contains(r.IP) {
+				return fmt.Errorf("client IP range %s overlaps reserved range %s", r.cidr, reserved)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteNetwork deletes the network named in the request, and its WireGuard device. Networks with clients or pools
+// cannot be deleted.
+func (s *Server) DeleteNetwork(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := ps.ByName("net")
+	n := s.networks[name]
+	if n == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if name == defaultNetwork {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	inUse := len(s.Config.poolRanges(name)) > 0
+	for _, user := range s.Config.Users {
+		for _, client := range user.Clients {
+			inUse = inUse || client.Network == name
+		}
+	}
+	if inUse {
+		log.WithField("network", name).Warn("Not deleting network with clients or pools")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if err := s.removeNetwork(n); err != nil {
+		log.WithField("network", name).Error("Error deleting device: ", err)
+	}
+	delete(s.networks, name)
+	delete(s.Config.Networks, name)
+	if err := s.Config.Write(); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("network", name).Info("Deleted network")
+	w.WriteHeader(http.StatusOK)
+}
+
+// RotateServerKey schedules a rotation of the server key after the grace period given in the request
+func (s *Server) RotateServerKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	req := struct {
+		Grace string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Warn("Error parsing request: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	grace, err := time.ParseDuration(req.Grace)
+	if err != nil {
+		log.Warn("Invalid grace period: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n := s.networkOf(ps)
+	if err := n.ScheduleKeyRotation(grace); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("network", n.name).Infof("Scheduled server key rotation at %s", n.KeyRotationAt)
+	s.writeServerInfo(w, n)
+}
+
+// CancelServerKeyRotation drops a scheduled rotation of the server key
+func (s *Server) CancelServerKeyRotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := s.networkOf(ps)
+	n.CancelKeyRotation()
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("user", r.Context().Value(key)).WithField("network", n.name).Info("Cancelled server key rotation")
+	s.writeServerInfo(w, n)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errIPExhausted = errors.New("address range exhausted")
+	errIPInUse     = errors.New("address already in use")
+	errIPInvalid   = errors.New("address not within a client IP range")
+)
+
+// ipRange is a range client addresses are allocated from
+type ipRange struct {
+	// cidr is the range as given on the command line, also used as the address of the WireGuard device
+	cidr string
+	// serverIP is the address of the WireGuard device within the range
+	serverIP net.IP
+	*net.IPNet
+}
+
+func (r ipRange) isIPv6() bool {
+	return r.IP.To4() == nil
+}
+
+// broadcast returns the broadcast address of an IPv4 range, or nil for an IPv6 range, which has none
+func (r ipRange) broadcast() net.IP {
+	if r.isIPv6() {
+		return nil
+	}
+	return lastIP(r.IPNet)
+}
+
+// hostAddress returns whether ip may be given to a host: it is neither the network nor the broadcast address
+func (r ipRange) hostAddress(ip net.IP) bool {
+	return !ip.Equal(r.IP) && !ip.Equal(r.broadcast())
+}
+
+// hasClientAddress returns whether the range has a host address left for a client besides the server address
+func (r ipRange) hasClientAddress() bool {
+	ones, bits := r.Mask.Size()
+	if bits-ones > 2 {
+		return true
+	}
+	// Ranges this small have at most 4 addresses
+	for i, ip := 0, r.IP; i < 4 && r.Contains(ip); i, ip = i+1, nextIP(ip) {
+		if r.hostAddress(ip) && !ip.Equal(r.serverIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllocator hands out client addresses from a set of ranges. It keeps track of the addresses in use, so allocating
+// does not need to look at every client, and continues after the last address handed out rather than filling gaps
+// right away.
+type ipAllocator struct {
+	ranges   []ipRange
+	pools    []*net.IPNet
+	next     map[string]net.IP
+	reserved []*net.IPNet
+	cooldown time.Duration
+	inUse    map[string]bool
+	// freed holds when addresses were released, as RFC3339, and is persisted in the config
+	freed map[string]string
+}
+
+// newIPAllocator returns an allocator for the ranges of a network, which never hands out addresses in reserved ranges
+// automatically, nor addresses released less than cooldown ago. The addresses of the clients of the network are in
+// use.
+func newIPAllocator(cfg *ServerConfig, network string, ranges []ipRange, reserved []*net.IPNet, cooldown time.Duration) *ipAllocator {
+	if cfg.FreedIPs == nil {
+		cfg.FreedIPs = make(map[string]string)
+	}
+
+	a := &ipAllocator{
+		ranges:   ranges,
+		pools:    cfg.poolRanges(network),
+		next:     make(map[string]net.IP),
+		reserved: reserved,
+		cooldown: cooldown,
+		inUse:    make(map[string]bool),
+		freed:    cfg.FreedIPs,
+	}
+	for _, r := range ranges {
+		a.inUse[r.serverIP.String()] = true
+	}
+	for _, user := range cfg.Users {
+		for _, client := range user.Clients {
+			if client.Network != network {
+				continue
+			}
+			a.inUse[client.IP.String()] = true
+			if client.IPv6 != nil {
+				a.inUse[client.IPv6.String()] = true
+			}
+		}
+	}
+	return a
+}
+
+// setPools replaces the pools, whose addresses are only allocated to their members
+func (a *ipAllocator) setPools(pools []*net.IPNet) {
+	a.pools = pools
+}
+
+// Allocate returns a free address of the given IP version from pool, or outside of all pools if pool is nil
+func (a *ipAllocator) Allocate(ipv6 bool, pool *net.IPNet) (net.IP, error) {
+	now := time.Now()
+	if pool != nil {
+		if ip := a.scan(pool, now, false); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("pool %s: %w", pool, errIPExhausted)
+	}
+
+	for _, r := range a.ranges {
+		if r.isIPv6() != ipv6 {
+			continue
+		}
+		if ip := a.scan(r.IPNet, now, true); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errIPExhausted
+}
+
+// scan returns a free address of block, looking from the one following the address it returned last. Reserved
+// ranges, and pools if skipPools is set, are jumped over as a whole, so that they do not have to be looked at address
+// by address, which would take forever in an IPv6 range.
+func (a *ipAllocator) scan(block *net.IPNet, now time.Time, skipPools bool) net.IP {
+	start := a.next[block.String()]
+	if start == nil || !block.Contains(start) {
+		start = block.IP
+	}
+
+	ip, wrapped := start, false
+	for {
+		if wrapped && compareIPs(ip, start) >= 0 {
+			return nil
+		}
+
+		if excluded := a.excluded(ip, skipPools); excluded != nil {
+			ip = nextIP(lastIP(excluded))
+		} else if a.available(ip, now, skipPools) {
+			a.inUse[ip.String()] = true
+			a.next[block.String()] = nextIP(ip)
+			log.Debug("Allocated IP: ", ip)
+			return ip
+		} else {
+			ip = nextIP(ip)
+		}
+
+		// Also catches an excluded range reaching the end of the address space, after which nextIP starts over at 0
+		if !block.Contains(ip) || compareIPs(ip, block.IP) < 0 {
+			if wrapped {
+				return nil
+			}
+			ip, wrapped = block.IP, true
+		}
+	}
+}
+
+// Assign marks a specific address as in use, allowing admins to give a client a static address. Unlike Allocate, it
+// hands out addresses in reserved ranges and addresses cooling down.
+func (a *ipAllocator) Assign(ip net.IP) error {
+	inRange := false
+	for _, r := range a.ranges {
+		if r.Contains(ip) && r.hostAddress(ip) {
+			inRange = true
+			break
+		}
+	}
+	if !inRange {
+		return fmt.Errorf("%s: %w", ip, errIPInvalid)
+	}
+	if a.inUse[ip.String()] {
+		return fmt.Errorf("%s: %w", ip, errIPInUse)
+	}
+
+	a.inUse[ip.String()] = true
+	delete(a.freed, ip.String())
+	log.Debug("Assigned IP: ", ip)
+	return nil
+}
+
+// Release returns an address, which is handed out again once the cooldown has passed
+func (a *ipAllocator) Release(ip net.IP) {
+	if ip == nil {
+		return
+	}
+
+	delete(a.inUse, ip.String())
+	if a.cooldown > 0 {
+		a.freed[ip.String()] = time.Now().Format(time.RFC3339)
+	}
+	log.Debug("Released IP: ", ip)
+}
+
+// cancel returns an address that was allocated or assigned but not used, without a cooldown
+func (a *ipAllocator) cancel(ip net.IP) {
+	delete(a.inUse, ip.String())
+}
+
+// excluded returns the reserved range, or, if skipPools is set, the pool ip is in, nil if it is in neither
+func (a *ipAllocator) excluded(ip net.IP, skipPools bool) *net.IPNet {
+	for _, r := range a.reserved {
+		if r.Contains(ip) {
+			return r
+		}
+	}
+	if skipPools {
+		for _, p := range a.pools {
+			if p.Contains(ip) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+func (a *ipAllocator) available(ip net.IP, now time.Time, skipPools bool) bool {
+	if a.inUse[ip.String()] {
+		return false
+	}
+	for _, r := range a.ranges {
+		if r.Contains(ip) && !r.hostAddress(ip) {
+			return false
+		}
+	}
+	if a.excluded(ip, skipPools) != nil {
+		return false
+	}
+
+	if freed, ok := a.freed[ip.String()]; ok {
+		t, err := time.Parse(time.RFC3339, freed)
+		if err == nil && now.Before(t.Add(a.cooldown)) {
+			return false
+		}
+		delete(a.freed, ip.String())
+	}
+	return true
+}
+
+// lastIP returns the last address of n
+func lastIP(n *net.IPNet) net.IP {
+	ip := n.IP.To16()
+	if len(n.Mask) == net.IPv4len {
+		ip = n.IP.To4()
+	}
+	last := make(net.IP, len(ip))
+	for i := range last {
+		last[i] = ip[i] | ^n.Mask[i]
+	}
+	return last
+}
+
+// compareIPs compares two addresses of the same version like bytes.Compare
+func compareIPs(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// nextIP returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] > 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestAllocator returns an allocator of the given client IP ranges, without clients
+func newTestAllocator(t *testing.T, cidrs []string, reserved []string, cooldown time.Duration) *ipAllocator {
+	ranges, err := parseIPRanges(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIPAllocator(&ServerConfig{}, defaultNetwork, ranges, parseCIDRs(t, reserved), cooldown)
+}
+
+// parseCIDRs parses a list of CIDRs
+func parseCIDRs(t *testing.T, cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// allocate allocates an address, failing the test if there is none
+func allocate(t *testing.T, a *ipAllocator, ipv6 bool, pool *net.IPNet) net.IP {
+	t.Helper()
+	ip, err := a.Allocate(ipv6, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip
+}
+
+func TestAllocatorExhaustion(t *testing.T) {
+	a := newTestAllocator(t, []string{"10.0.0.1/29"}, nil, 0)
+
+	// .0 is the network, .1 the server and .7 the broadcast address
+	for _, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		if ip := allocate(t, a, false, nil); ip.String() != want {
+			t.Errorf("got %s, want %s", ip, want)
+		}
+	}
+	if ip, err := a.Allocate(false, nil); !errors.Is(err, errIPExhausted) {
+		t.Errorf("got %s and error %v, want %v", ip, err, errIPExhausted)
+	}
+	if ip, err := a.Allocate(true, nil); !errors.Is(err, errIPExhausted) {
+		t.Errorf("got IPv6 address %s and error %v without an IPv6 range, want %v", ip, err, errIPExhausted)
+	}
+}
+
+func TestAllocatorCooldown(t *testing.T) {
+	a := newTestAllocator(t, []string{"10.0.0.1/30"}, nil, time.Hour)
+
+	ip := allocate(t, a, false, nil)
+	if ip.String() != "10.0.0.2" {
+		t.Fatalf("got %s, want 10.0.0.2", ip)
+	}
+	a.Release(ip)
+	if ip, err := a.Allocate(false, nil); !errors.Is(err, errIPExhausted) {
+		t.Errorf("got %s and error %v during the cooldown, want %v", ip, err, errIPExhausted)
+	}
+
+	a.freed[ip.String()] = time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	if got := allocate(t, a, false, nil); !got.Equal(ip) {
+		t.Errorf("got %s after the cooldown, want %s", got, ip)
+	}
+	if _, ok := a.freed[ip.String()]; ok {
+		t.Error("address still cooling down after it was allocated again")
+	}
+
+	// Admins may assign addresses that are cooling down
+	a.Release(ip)
+	if err := a.Assign(ip); err != nil {
+		t.Errorf("got error %v assigning an address cooling down", err)
+	}
+}
+
+func TestAllocatorWrapAround(t *testing.T) {
+	a := newTestAllocator(t, []string{"10.0.0.1/29"}, nil, 0)
+
+	var ips []net.IP
+	for i := 0; i < 5; i++ {
+		ips = append(ips, allocate(t, a, false, nil))
+	}
+	// Gaps are only filled once the end of the range is reached, from its start
+	a.Release(ips[3])
+	a.Release(ips[1])
+	for _, want := range []net.IP{ips[1], ips[3]} {
+		if got := allocate(t, a, false, nil); !got.Equal(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if ip, err := a.Allocate(false, nil); !errors.Is(err, errIPExhausted) {
+		t.Errorf("got %s and error %v, want %v", ip, err, errIPExhausted)
+	}
+}
+
+func TestAllocatorSkipsPoolsAndReserved(t *testing.T) {
+	a := newTestAllocator(t, []string{"10.0.0.1/24"}, []string{"10.0.0.0/28"}, 0)
+	pools := parseCIDRs(t, []string{"10.0.0.16/28", "10.0.0.64/26"})
+	a.setPools(pools)
+
+	if ip := allocate(t, a, false, nil); ip.String() != "10.0.0.32" {
+		t.Errorf("got %s, want 10.0.0.32 after the reserved range and the first pool", ip)
+	}
+	if ip := allocate(t, a, false, pools[0]); ip.String() != "10.0.0.16" {
+		t.Errorf("got %s from pool %s, want 10.0.0.16", ip, pools[0])
+	}
+
+	// Ranges excluded up to its end are wrapped around
+	a.next["10.0.0.0/24"] = net.ParseIP("10.0.0.200").To4()
+	a.reserved = parseCIDRs(t, []string{"10.0.0.0/28", "10.0.0.192/26"})
+	if ip := allocate(t, a, false, nil); ip.String() != "10.0.0.33" {
+		t.Errorf("got %s, want 10.0.0.33", ip)
+	}
+
+	// Reserved addresses can still be assigned by admins
+	if err := a.Assign(net.ParseIP("10.0.0.5")); err != nil {
+		t.Errorf("got error %v assigning a reserved address", err)
+	}
+}
+
+func TestAllocatorLargeIPv6Pools(t *testing.T) {
+	a := newTestAllocator(t, []string{"10.0.0.1/24", "fd00::1/64"}, []string{"fd00::/96"}, 0)
+	pools := parseCIDRs(t, []string{"fd00::/80", "fd00:0:0:0:1::/80"})
+	a.setPools(pools)
+
+	done := make(chan net.IP)
+	go func() {
+		ip, _ := a.Allocate(true, nil)
+		done <- ip
+	}()
+	select {
+	case ip := <-done:
+		if ip.String() != "fd00::2:0:0:0" {
+			t.Errorf("got %s, want fd00::2:0:0:0", ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("allocation walked through the pools address by address")
+	}
+
+	// Pools and reserved ranges covering the whole range exhaust it
+	a.setPools(parseCIDRs(t, []string{"fd00::/65", "fd00::8000:0:0:0/65"}))
+	if ip, err := a.Allocate(true, nil); !errors.Is(err, errIPExhausted) {
+		t.Errorf("got %s and error %v, want %v", ip, err, errIPExhausted)
+	}
+}
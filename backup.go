@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backupTimeFormat is the suffix of a config generation. It sorts lexically in the order the generations were taken.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// writeFileAtomic writes data to a temporary file next to filename, syncs it and renames it into place so that
+// filename holds either the old or the new data, never a partial write
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// backupFile keeps the current contents of filename as a new generation next to it
+func backupFile(filename string) error {
+	generation := filename + "." + time.Now().UTC().Format(backupTimeFormat)
+
+	err := os.Link(filename, generation)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+
+	log.WithError(err).Debug("Unable to hard link backup, copying instead: ", generation)
+	data, err := ioutil.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(generation, data, 0600)
+}
+
+// listBackups returns the generations kept next to filename, oldest first
+func listBackups(filename string) ([]string, error) {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	generations := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, filename+".")); err == nil {
+			generations = append(generations, m)
+		}
+	}
+	sort.Strings(generations)
+	return generations, nil
+}
+
+// pruneBackups removes all but the keep most recent generations of filename
+func pruneBackups(filename string, keep int) error {
+	generations, err := listBackups(filename)
+	if err != nil {
+		return err
+	}
+	for len(generations) > keep {
+		log.Debug("Removing old config generation: ", generations[0])
+		if err := os.Remove(generations[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// writeBackup stores cfg as a new config.json generation in dir, regardless of which storage is used
+func writeBackup(dir string, cfg *ServerConfig) (string, error) {
+	sealed, err := cfg.sealed()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(sealed, "", " ")
+	if err != nil {
+		return "", err
+	}
+
+	base := path.Join(dir, "config.json")
+	generation := base + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := writeFileAtomic(generation, data, 0600); err != nil {
+		return "", err
+	}
+	// Generations written before a restore or migration are kept even with --config-backups=0, they may be the only
+	// way back
+	if *configBackups == 0 {
+		return generation, nil
+	}
+	return generation, pruneBackups(base, *configBackups)
+}
+
+// restoreBackup replaces the stored config with the given generation of config.json in dir. The generation
+// may be given either as its timestamp or as its file name.
+func restoreBackup(storage Storage, dir string, generation string) error {
+	base := path.Join(dir, "config.json")
+	generation = strings.TrimPrefix(filepath.Base(generation), "config.json.")
+	if _, err := time.Parse(backupTimeFormat, generation); err != nil {
+		return fmt.Errorf("invalid generation %q", generation)
+	}
+
+	cfg := &ServerConfig{}
+	if err := (&jsonStorage{path: base + "." + generation}).Load(cfg); err != nil {
+		return err
+	}
+
+	// The JSON storage keeps the config being replaced as a generation of its own while saving
+	if _, ok := storage.(*jsonStorage); !ok {
+		current := &ServerConfig{}
+		err := storage.Load(current)
+		if err == nil {
+			var backup string
+			if backup, err = writeBackup(dir, current); err == nil {
+				log.Info("Saved current config as: ", backup)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := storage.Save(cfg); err != nil {
+		return err
+	}
+	log.Info("Restored config generation: ", generation)
+	return nil
+}
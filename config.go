@@ -1,43 +1,110 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
+	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// ServerConfig contains the reference to users, keys and where on disk the config is stored
+// defaultNetwork is the network configured with the command line flags, which clients are created in unless another
+// one is given
+const defaultNetwork = "default"
+
+// ServerConfig contains the reference to users, networks and the storage the config is kept in
 type ServerConfig struct {
-	configPath string
-	PrivateKey string
-	PublicKey  string
-	Users      map[string]*UserConfig
+	storage       Storage
+	keyring       *keyring
+	SchemaVersion int
+	// PrivateKey and PublicKey are the server key of configs before networks, moved to the default network
+	PrivateKey     string `json:",omitempty"`
+	PublicKey      string `json:",omitempty"`
+	NextPrivateKey string `json:",omitempty"`
+	NextPublicKey  string `json:",omitempty"`
+	KeyRotationAt  string `json:",omitempty"`
+	KeyRotatedAt   string `json:",omitempty"`
+	Networks       map[string]*NetworkConfig
+	Users          map[string]*UserConfig
+	// FreedIPs holds when client addresses were released, so they are not handed out again right away. Networks do not
+	// overlap, so an address identifies the network it belongs to.
+	FreedIPs   map[string]string      `json:",omitempty"`
+	Pools      map[string]*PoolConfig `json:",omitempty"`
+	Encryption *EncryptionConfig      `json:",omitempty"`
+}
+
+// NetworkConfig is a WireGuard interface of the server, with the server key used on it
+type NetworkConfig struct {
+	Device     string
+	ListenPort int
+	// IPRanges are the client IP CIDRs, including the address of the server
+	IPRanges       []string
+	Endpoint       string
+	AllowedIPs     []string
+	PrivateKey     string
+	PublicKey      string
+	NextPrivateKey string `json:",omitempty"`
+	NextPublicKey  string `json:",omitempty"`
+	KeyRotationAt  string `json:",omitempty"`
+	KeyRotatedAt   string `json:",omitempty"`
 }
 
 // UserConfig represents a user and it's clients
 type UserConfig struct {
 	Name    string
 	Clients map[string]*ClientConfig
+	// Groups are the groups the user was in when creating a client last
+	Groups []string `json:",omitempty"`
+	// ACL holds the rules applying to all clients of the user, in addition to their own
+	ACL []ACLRule `json:",omitempty"`
+}
+
+// ACLRule allows a client to reach a destination through the WireGuard device. Once a client has rules, its own or
+// those of its user, it may only reach what they allow.
+type ACLRule struct {
+	Destination string
+	// Protocol is tcp, udp or icmp, any protocol if empty
+	Protocol string `json:",omitempty"`
+	// Ports holds ports like 443 and port ranges like 8000-8100, all ports if empty. Only for tcp and udp.
+	Ports []string `json:",omitempty"`
+}
+
+// PoolConfig is a part of the client IP ranges whose addresses are only allocated to the clients of certain users,
+// or of members of certain groups
+type PoolConfig struct {
+	// Network is the network the pool is part of, the default network if empty
+	Network string `json:",omitempty"`
+	// Ranges holds a CIDR per IP version
+	Ranges []string
+	Users  []string
+	Groups []string
 }
 
 // ClientConfig represents a single client for a user
 type ClientConfig struct {
 	Name         string
+	Network      string
 	PrivateKey   string
 	PublicKey    string
 	PresharedKey string
 	IP           net.IP
+	IPv6         net.IP `json:",omitempty"`
 	AllowedIPs   []*net.IPNet
-	MTU          int
-	Notes        string
-	Created      string
-	Modified     string
+	// Routes, DNS, DNSSearch and PersistentKeepalive override the settings of the client side of the tunnel
+	Routes              []string  `json:",omitempty"`
+	DNS                 []string  `json:",omitempty"`
+	DNSSearch           []string  `json:",omitempty"`
+	PersistentKeepalive *int      `json:",omitempty"`
+	ACL                 []ACLRule `json:",omitempty"`
+	MTU                 int
+	Notes               string
+	Created             string
+	Modified            string
+	ExpiresAt           string
+	Disabled            bool
+	DisabledBy          string
 }
 
 // NewClient provides fields that should not be saved however is neccesary on creation of a new client
@@ -46,52 +113,42 @@ type NewClient struct {
 	GeneratePSK bool
 }
 
-// NewServerConfig creates and returns a reference to a new ServerConfig
-func NewServerConfig(cfgPath string) *ServerConfig {
-	key, err := wgtypes.GeneratePrivateKey()
-	if err != nil {
-		log.Fatal(err)
-	}
-
+// NewServerConfig creates and returns a reference to a new ServerConfig, with its secrets encrypted by a data key
+// wrapped with wrapper unless it is nil
+func NewServerConfig(storage Storage, wrapper keyWrapper) *ServerConfig {
 	cfg := &ServerConfig{
-		configPath: cfgPath,
-		PrivateKey: key.String(),
-		PublicKey:  key.PublicKey().String(),
-		Users:      make(map[string]*UserConfig),
+		storage:  storage,
+		Networks: make(map[string]*NetworkConfig),
+		Users:    make(map[string]*UserConfig),
 	}
 
-	f, err := os.Open(filepath.Clean(cfgPath))
-	if err == nil {
-		if err = json.NewDecoder(f).Decode(cfg); err != nil {
-			log.Fatal(err)
+	configWriteRequired := false
+
+	err := storage.Load(cfg)
+	if os.IsNotExist(err) {
+		log.Debug("No config found. Creating new")
+		cfg.SchemaVersion = currentSchemaVersion()
+		if err = cfg.setDataKey(wrapper); err == nil {
+			err = cfg.Write()
+		}
+	} else if err == nil {
+		encrypted := cfg.Encryption != nil
+		err = cfg.unseal(wrapper)
+		if !encrypted && cfg.Encryption != nil {
+			log.Info("Encrypting the keys in the stored config")
+			configWriteRequired = true
 		}
-		log.Debug("Read server config from file: ", cfgPath)
-	} else if os.IsNotExist(err) {
-		log.Debug("No config found. Creating new: ", cfgPath)
-		err = cfg.Write()
 	}
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	configWriteRequired := false
-
-	// Set default MTU if MTU is not set (migration from old config)
-	migrationMTU := *wgPeerMtu
-	if err := verifyLinkMTU(migrationMTU); err != nil {
-		log.WithError(err).Warnf("Invalid peer MTU, migration MTU is set to %d", wgDefaultMtu)
-		migrationMTU = wgDefaultMtu
-	}
-
-	for _, user := range cfg.Users {
-		for _, client := range user.Clients {
-			if client.MTU == 0 {
-				client.MTU = migrationMTU
-				configWriteRequired = true
-			}
-		}
+	migrated, err := cfg.migrate(*dataDir)
+	if err != nil {
+		log.Fatal(err)
 	}
+	configWriteRequired = configWriteRequired || migrated
 
 	if configWriteRequired {
 		err = cfg.Write()
@@ -103,13 +160,93 @@ func NewServerConfig(cfgPath string) *ServerConfig {
 	return cfg
 }
 
-// Write writes the ServerConfig to the path specified in the config
+// Write writes the ServerConfig to its storage
 func (cfg *ServerConfig) Write() error {
-	data, err := json.MarshalIndent(cfg, "", " ")
+	sealed, err := cfg.sealed()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(cfg.configPath, data, 0600)
+	return cfg.storage.Save(sealed)
+}
+
+// newNetworkConfig returns a network with a new server key
+func newNetworkConfig() (*NetworkConfig, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkConfig{
+		PrivateKey: key.String(),
+		PublicKey:  key.PublicKey().String(),
+	}, nil
+}
+
+// ScheduleKeyRotation generates the next server key, which replaces the current one once grace has passed. Both keys
+// are published in the meantime, letting users fetch configs for the next key ahead of the switch.
+func (n *NetworkConfig) ScheduleKeyRotation(grace time.Duration) error {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	n.NextPrivateKey = key.String()
+	n.NextPublicKey = key.PublicKey().String()
+	n.KeyRotationAt = now.Add(grace).Format(time.RFC3339)
+	if grace <= 0 {
+		n.completeKeyRotation(now)
+	}
+	return nil
+}
+
+// CancelKeyRotation drops a scheduled key rotation
+func (n *NetworkConfig) CancelKeyRotation() {
+	n.NextPrivateKey = ""
+	n.NextPublicKey = ""
+	n.KeyRotationAt = ""
+}
+
+// keyRotationDue returns whether the grace period of a scheduled key rotation has passed
+func (n *NetworkConfig) keyRotationDue(now time.Time) bool {
+	if n.NextPrivateKey == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, n.KeyRotationAt)
+	return err != nil || !now.Before(t)
+}
+
+// completeKeyRotation replaces the server key with the next one
+func (n *NetworkConfig) completeKeyRotation(now time.Time) {
+	n.PrivateKey = n.NextPrivateKey
+	n.PublicKey = n.NextPublicKey
+	n.CancelKeyRotation()
+	n.KeyRotatedAt = now.Format(time.RFC3339)
+}
+
+// publicKeyInUse returns whether a public key, in the standard encoding, already belongs to the server or any client
+func (cfg *ServerConfig) publicKeyInUse(publicKey string) bool {
+	for _, n := range cfg.Networks {
+		if publicKey == normalizeKey(n.PublicKey) || publicKey == normalizeKey(n.NextPublicKey) {
+			return true
+		}
+	}
+	for _, user := range cfg.Users {
+		for _, client := range user.Clients {
+			if normalizeKey(client.PublicKey) == publicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeKey returns a key in the standard encoding, or as it is if it is not a valid key
+func normalizeKey(k string) string {
+	key, err := wgtypes.ParseKey(k)
+	if err != nil {
+		return k
+	}
+	return key.String()
 }
 
 // GetUserConfig returns a UserConfig for a specific user
@@ -126,11 +263,115 @@ func (cfg *ServerConfig) GetUserConfig(user string) *UserConfig {
 	return c
 }
 
-// NewClientConfig initiates a new client, returning a reference to the new config
-func NewClientConfig(Name string, ip net.IP, mtu int, Notes string, generatePSK bool) *ClientConfig {
-	key, err := wgtypes.GeneratePrivateKey()
+// poolRanges returns the ranges of all pools of a network
+func (cfg *ServerConfig) poolRanges(network string) []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, pool := range cfg.Pools {
+		if pool.network() != network {
+			continue
+		}
+		for _, cidr := range pool.Ranges {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				ranges = append(ranges, ipNet)
+			}
+		}
+	}
+	return ranges
+}
+
+// countIPs returns how many client addresses of a network are within ipNet
+func (cfg *ServerConfig) countIPs(network string, ipNet *net.IPNet) int {
+	n := 0
+	for _, user := range cfg.Users {
+		for _, client := range user.Clients {
+			if client.Network != network {
+				continue
+			}
+			if ipNet.Contains(client.IP) || (client.IPv6 != nil && ipNet.Contains(client.IPv6)) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// poolFor returns the name of the pool of a network the clients of a user get their addresses from, or "" if there is
+// none. A pool listing the user is preferred over one listing one of its groups, and pools are looked at ordered by
+// name.
+func (cfg *ServerConfig) poolFor(network string, user string, groups []string) string {
+	names := make([]string, 0, len(cfg.Pools))
+	for name, pool := range cfg.Pools {
+		if pool.network() == network {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, u := range cfg.Pools[name].Users {
+			if u == user {
+				return name
+			}
+		}
+	}
+	for _, name := range names {
+		for _, g := range cfg.Pools[name].Groups {
+			for _, group := range groups {
+				if g == group {
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// network returns the name of the network the pool is part of
+func (p *PoolConfig) network() string {
+	if p.Network == "" {
+		return defaultNetwork
+	}
+	return p.Network
+}
+
+// rangeFor returns the range of the pool for the given IP version, or nil if it has none
+func (p *PoolConfig) rangeFor(ipv6 bool) *net.IPNet {
+	if p == nil {
+		return nil
+	}
+	for _, cidr := range p.Ranges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && (ipNet.IP.To4() == nil) == ipv6 {
+			return ipNet
+		}
+	}
+	return nil
+}
+
+// expired returns whether the client's access has expired at the given time
+func (c *ClientConfig) expired(now time.Time) bool {
+	if c.ExpiresAt == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, c.ExpiresAt)
 	if err != nil {
-		log.Fatal(err)
+		log.WithError(err).Warnf("Invalid expiry of client %s, treating it as expired", c.Name)
+		return true
+	}
+	return !now.Before(t)
+}
+
+// NewClientConfig initiates a new client, returning a reference to the new config. A key pair is generated unless the
+// public key of a key pair kept on the client is given.
+func NewClientConfig(Name string, ip net.IP, mtu int, Notes string, generatePSK bool, publicKey string) *ClientConfig {
+	privateKey := ""
+	if publicKey == "" {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		privateKey = key.String()
+		publicKey = key.PublicKey().String()
 	}
 
 	psk := ""
@@ -144,8 +385,8 @@ func NewClientConfig(Name string, ip net.IP, mtu int, Notes string, generatePSK
 
 	cfg := ClientConfig{
 		Name:         Name,
-		PrivateKey:   key.String(),
-		PublicKey:    key.PublicKey().String(),
+		PrivateKey:   privateKey,
+		PublicKey:    publicKey,
 		IP:           ip,
 		MTU:          mtu,
 		PresharedKey: psk,
@@ -156,3 +397,30 @@ func NewClientConfig(Name string, ip net.IP, mtu int, Notes string, generatePSK
 
 	return &cfg
 }
+
+// RotateKeys replaces the key pair of the client, as well as its preshared key if rotatePSK is set. A new key pair is
+// generated unless the public key of a key pair kept on the client is given.
+func (c *ClientConfig) RotateKeys(publicKey string, rotatePSK bool) error {
+	if publicKey != "" {
+		c.PrivateKey = ""
+		c.PublicKey = publicKey
+	} else {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		c.PrivateKey = key.String()
+		c.PublicKey = key.PublicKey().String()
+	}
+
+	if rotatePSK {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return err
+		}
+		c.PresharedKey = psk.String()
+	}
+
+	c.Modified = time.Now().Format(time.RFC3339)
+	return nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sealedPrefix marks a secret in the stored config as encrypted with the data key, bound to its location in the
+	// config
+	sealedPrefix = "enc:v2:"
+	// legacySealedPrefix marks a secret encrypted by older versions, which could be moved to another location
+	legacySealedPrefix = "enc:v1:"
+	// encryptionVersion is the version of configs whose secrets are all bound to their location
+	encryptionVersion = 2
+)
+
+// EncryptionConfig describes how the secrets in the stored config are encrypted
+type EncryptionConfig struct {
+	// DataKey is the key encrypting the secrets, itself encrypted with the master key
+	DataKey string
+	// Version is 2 once all secrets are bound to their location, after which secrets of older versions are refused
+	Version int `json:",omitempty"`
+}
+
+// keyWrapper encrypts and decrypts data keys with a master key
+type keyWrapper interface {
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// newKeyWrapper returns the key wrapper for a master key source, which is one of
+//
+//	file:/path/to/key          a file containing the key, raw or base64 encoded
+//	env:VARIABLE               an environment variable containing the base64 encoded key
+//	kms+http://host:port/key   the given key of a service speaking the AWS KMS API
+//
+// An empty source disables encryption.
+func newKeyWrapper(source string) (keyWrapper, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key source: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		data, err := ioutil.ReadFile(filepath.Clean(u.Path))
+		if err != nil {
+			return nil, err
+		}
+		return newStaticKeyWrapper(data)
+	case "env":
+		data, ok := os.LookupEnv(u.Opaque)
+		if !ok {
+			return nil, fmt.Errorf("master key environment variable %s is not set", u.Opaque)
+		}
+		return newStaticKeyWrapper([]byte(data))
+	case "kms+http", "kms+https":
+		return &kmsKeyWrapper{
+			endpoint: strings.TrimPrefix(u.Scheme, "kms+") + "://" + u.Host,
+			keyID:    strings.TrimPrefix(u.Path, "/"),
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown master key source: %s", source)
+	}
+}
+
+// staticKeyWrapper wraps data keys with a locally held AES-256 master key
+type staticKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+func newStaticKeyWrapper(key []byte) (*staticKeyWrapper, error) {
+	key = bytes.TrimSpace(key)
+	if len(key) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(string(key))
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("master key must be 32 bytes, raw or base64 encoded")
+		}
+		key = decoded
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &staticKeyWrapper{aead: aead}, nil
+}
+
+func (w *staticKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	return aeadSeal(w.aead, dataKey, nil)
+}
+
+func (w *staticKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	return aeadOpen(w.aead, wrapped, nil)
+}
+
+// kmsKeyWrapper wraps data keys using the Encrypt and Decrypt calls of a KMS compatible service, such as local-kms
+type kmsKeyWrapper struct {
+	endpoint string
+	keyID    string
+	client   *http.Client
+}
+
+func (w *kmsKeyWrapper) call(action string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("kms %s: %s: %s", action, res.Status, msg)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+func (w *kmsKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	res := struct{ CiphertextBlob []byte }{}
+	err := w.call("Encrypt", struct {
+		KeyId     string
+		Plaintext []byte
+	}{w.keyID, dataKey}, &res)
+	return res.CiphertextBlob, err
+}
+
+func (w *kmsKeyWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	res := struct{ Plaintext []byte }{}
+	err := w.call("Decrypt", struct {
+		KeyId          string
+		CiphertextBlob []byte
+	}{w.keyID, wrapped}, &res)
+	return res.Plaintext, err
+}
+
+// keyring encrypts the secrets of a config with its data key
+type keyring struct {
+	aead cipher.AEAD
+	// legacy accepts secrets of older versions, not bound to their location
+	legacy bool
+	mutex  sync.Mutex
+	// sealed remembers the ciphertext of every secret, by location and plaintext, so unchanged secrets are stored
+	// unchanged
+	sealed map[string]string
+}
+
+func newKeyring(dataKey []byte) (*keyring, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{
+		aead:   aead,
+		sealed: make(map[string]string),
+	}, nil
+}
+
+// Seal encrypts a secret, binding it to its location in the config, like network/wg0/PrivateKey, so that it cannot be
+// copied to another one
+func (k *keyring) Seal(location, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if s, ok := k.sealed[location+"\x00"+plaintext]; ok {
+		return s, nil
+	}
+
+	data, err := aeadSeal(k.aead, []byte(plaintext), []byte(location))
+	if err != nil {
+		return "", err
+	}
+	s := sealedPrefix + base64.StdEncoding.EncodeToString(data)
+	k.sealed[location+"\x00"+plaintext] = s
+	return s, nil
+}
+
+// Open decrypts the secret at location. Secrets which are not encrypted are returned as is.
+func (k *keyring) Open(location, s string) (string, error) {
+	if strings.HasPrefix(s, legacySealedPrefix) {
+		if !k.legacy {
+			return "", fmt.Errorf("%s: secret of an older encryption version", location)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, legacySealedPrefix))
+		if err != nil {
+			return "", err
+		}
+		// Not remembered, so that it is sealed again bound to its location
+		plaintext, err := aeadOpen(k.aead, data, nil)
+		return string(plaintext), err
+	}
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aeadOpen(k.aead, data, []byte(location))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", location, err)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.sealed[location+"\x00"+string(plaintext)] = s
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aeadSeal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func aeadOpen(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
+
+// unseal decrypts the secrets of a config read from storage and keeps the data key for sealing it again. A config
+// which is not yet encrypted gets a new data key if wrapper is set.
+func (cfg *ServerConfig) unseal(wrapper keyWrapper) error {
+	if cfg.Encryption == nil {
+		if wrapper == nil {
+			return nil
+		}
+		return cfg.setDataKey(wrapper)
+	}
+
+	if wrapper == nil {
+		return fmt.Errorf("config is encrypted but no master key is configured")
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(cfg.Encryption.DataKey)
+	if err != nil {
+		return err
+	}
+	dataKey, err := wrapper.Unwrap(wrapped)
+	if err != nil {
+		return fmt.Errorf("unwrap data key: %w", err)
+	}
+	cfg.keyring, err = newKeyring(dataKey)
+	if err != nil {
+		return err
+	}
+	cfg.keyring.legacy = cfg.Encryption.Version < encryptionVersion
+
+	err = cfg.eachSecret(func(location string, s *string) (err error) {
+		*s, err = cfg.keyring.Open(location, *s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Older secrets are bound to their location when the config is written next
+	cfg.Encryption.Version = encryptionVersion
+	cfg.keyring.legacy = false
+	return nil
+}
+
+// setDataKey generates a new data key wrapped with wrapper, which the config is sealed with from then on. A nil
+// wrapper stores the config unencrypted.
+func (cfg *ServerConfig) setDataKey(wrapper keyWrapper) error {
+	if wrapper == nil {
+		cfg.Encryption = nil
+		cfg.keyring = nil
+		return nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	wrapped, err := wrapper.Wrap(dataKey)
+	if err != nil {
+		return fmt.Errorf("wrap data key: %w", err)
+	}
+	cfg.keyring, err = newKeyring(dataKey)
+	if err != nil {
+		return err
+	}
+	cfg.Encryption = &EncryptionConfig{
+		DataKey: base64.StdEncoding.EncodeToString(wrapped),
+		Version: encryptionVersion,
+	}
+	return nil
+}
+
+// sealed returns the config as it should be stored, with all secrets encrypted
+func (cfg *ServerConfig) sealed() (*ServerConfig, error) {
+	if cfg.keyring == nil {
+		return cfg, nil
+	}
+
+	sealed := *cfg
+	sealed.Networks = make(map[string]*NetworkConfig, len(cfg.Networks))
+	for name, network := range cfg.Networks {
+		n := *network
+		sealed.Networks[name] = &n
+	}
+	sealed.Users = make(map[string]*UserConfig, len(cfg.Users))
+	for name, user := range cfg.Users {
+		u := *user
+		u.Clients = make(map[string]*ClientConfig, len(user.Clients))
+		for id, client := range user.Clients {
+			c := *client
+			u.Clients[id] = &c
+		}
+		sealed.Users[name] = &u
+	}
+
+	err := sealed.eachSecret(func(location string, s *string) (err error) {
+		*s, err = cfg.keyring.Seal(location, *s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// eachSecret calls fn with every secret in the config and its location, like user/alice/client/1/PresharedKey
+func (cfg *ServerConfig) eachSecret(fn func(location string, s *string) error) error {
+	if err := fn("server/PrivateKey", &cfg.PrivateKey); err != nil {
+		return err
+	}
+	if err := fn("server/NextPrivateKey", &cfg.NextPrivateKey); err != nil {
+		return err
+	}
+	for name, network := range cfg.Networks {
+		if err := fn("network/"+name+"/PrivateKey", &network.PrivateKey); err != nil {
+			return err
+		}
+		if err := fn("network/"+name+"/NextPrivateKey", &network.NextPrivateKey); err != nil {
+			return err
+		}
+	}
+	for name, user := range cfg.Users {
+		for id, client := range user.Clients {
+			if err := fn("user/"+name+"/client/"+id+"/PrivateKey", &client.PrivateKey); err != nil {
+				return err
+			}
+			if err := fn("user/"+name+"/client/"+id+"/PresharedKey", &client.PresharedKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rekey re-encrypts everything in storage, as well as the config generations in dir, from the old master key to the
+// new one. The generations are re-encrypted into temporary files first, so that nothing is changed if one of them
+// cannot be, and only replaced once storage is.
+func rekey(storage Storage, dir string, oldWrapper keyWrapper, newWrapper keyWrapper) error {
+	rekeyConfig := func(storage Storage) error {
+		cfg := &ServerConfig{storage: storage}
+		if err := storage.Load(cfg); err != nil {
+			return err
+		}
+		if err := cfg.unseal(oldWrapper); err != nil {
+			return err
+		}
+		if err := cfg.setDataKey(newWrapper); err != nil {
+			return err
+		}
+		return cfg.Write()
+	}
+
+	generations, err := listBackups(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return err
+	}
+	rekeyed := make([]string, 0, len(generations))
+	defer func() {
+		for _, tmp := range rekeyed {
+			os.Remove(tmp)
+		}
+	}()
+	for _, g := range generations {
+		tmp := g + ".rekey"
+		if err := rekeyConfig(&generationStorage{path: g, out: tmp}); err != nil {
+			return fmt.Errorf("rekey %s: %w", g, err)
+		}
+		rekeyed = append(rekeyed, tmp)
+	}
+
+	// A generation kept of the config being replaced would still be encrypted with the old key
+	backups := *configBackups
+	*configBackups = 0
+	err = rekeyConfig(storage)
+	*configBackups = backups
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, g := range generations {
+		if err := os.Rename(rekeyed[i], g); err != nil {
+			log.WithError(err).Error("Error replacing config generation: ", g)
+			failed = append(failed, g)
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("the config was rekeyed, but these generations are still encrypted with the old master key: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// generationStorage rewrites a config generation, in place or to out if set
+type generationStorage struct {
+	path string
+	out  string
+}
+
+func (s *generationStorage) Load(cfg *ServerConfig) error {
+	return (&jsonStorage{path: s.path}).Load(cfg)
+}
+
+func (s *generationStorage) Save(cfg *ServerConfig) error {
+	data, err := json.MarshalIndent(cfg, "", " ")
+	if err != nil {
+		return err
+	}
+	if s.out != "" {
+		return writeFileAtomic(s.out, data, 0600)
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+func (s *generationStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// firewall installs the NAT and ACL rules of the server. Backends only touch tables and chains of their own, named
+// after wg-ui, and leave the rest of the host firewall alone. All methods can be called repeatedly, replacing the
+// rules installed before.
+type firewall interface {
+	// SetNAT masquerades traffic leaving through the NAT device, for the given IP versions, and removes the
+	// masquerading of the others
+	SetNAT(ipv4 bool, ipv6 bool) error
+	// SetACLs replaces the rules enforcing the ACLs. Traffic coming in through a device of closed is dropped unless
+	// an entry allows it.
+	SetACLs(entries []aclEntry, closed []string) error
+	// Cleanup removes the tables and chains of the server
+	Cleanup() error
+}
+
+// aclEntry holds the ACL rules of a client address or network, which may only reach what they allow through the device
+type aclEntry struct {
+	Device string
+	Source *net.IPNet
+	Rules  []ACLRule
+}
+
+// newFirewall returns the firewall backend of the given kind
+func newFirewall(kind string) (firewall, error) {
+	switch kind {
+	case "nftables":
+		return newNFTablesFirewall()
+	case "iptables":
+		return newIPTablesFirewall()
+	}
+	return nil, fmt.Errorf("unknown firewall: %s", kind)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptCost is the cost of the password hashes generated by wg-ui
+const bcryptCost = bcrypt.DefaultCost
+
+// usersCacheTTL is how long a successful login of a user of the users file is remembered, as browsers send the
+// credentials with every request and checking a bcrypt hash takes a while
+const usersCacheTTL = time.Minute
+
+// usersFile holds the users given by --auth-basic-users-file, lines of a username and the bcrypt hash of their
+// password separated by a colon, as in an htpasswd file
+type usersFile struct {
+	path string
+	// dummyHash is compared against for unknown users, taking as long as for existing ones so as not to tell which
+	// users exist
+	dummyHash []byte
+
+	mutex   sync.Mutex
+	modTime time.Time
+	users   map[string]string
+	// logins caches successful logins for usersCacheTTL
+	logins map[string]usersLogin
+}
+
+// usersLogin is a cached login
+type usersLogin struct {
+	password [sha256.Size]byte
+	// hash is the password hash the login was checked against, so that changing the password ends it
+	hash    string
+	expires time.Time
+}
+
+// newUsersFile reads the users file at path
+func newUsersFile(path string) (*usersFile, error) {
+	f := &usersFile{path: path, logins: make(map[string]usersLogin)}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("wireguard-ui"), bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	f.dummyHash = dummyHash
+	return f, nil
+}
+
+// reload reads the file again if it changed since it was last read, so that users added while the server is running
+// can log in right away. Must be called with the mutex held, or before the file is shared.
+func (f *usersFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.users != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	users, err := readUsers(f.path)
+	if err != nil {
+		return err
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	log.WithField("users", len(users)).Debug("Read users file")
+	return nil
+}
+
+// lookup returns the password hash of user
+func (f *usersFile) lookup(user string) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.reload(); err != nil {
+		log.Error("Error reading users file, using the users read before: ", err)
+	}
+	hash, ok := f.users[user]
+	return hash, ok
+}
+
+// exists returns whether user is in the file
+func (f *usersFile) exists(user string) bool {
+	_, ok := f.lookup(user)
+	return ok
+}
+
+// authenticate returns whether password is the password of user
+func (f *usersFile) authenticate(user, password string) bool {
+	hash, ok := f.lookup(user)
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(f.dummyHash, []byte(password))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	f.mutex.Lock()
+	login, cached := f.logins[user]
+	f.mutex.Unlock()
+	if cached && login.hash == hash && time.Now().Before(login.expires) && subtle.ConstantTimeCompare(login.password[:], sum[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	for u, l := range f.logins {
+		if now.After(l.expires) {
+			delete(f.logins, u)
+		}
+	}
+	f.logins[user] = usersLogin{password: sum, hash: hash, expires: now.Add(usersCacheTTL)}
+	return true
+}
+
+// readUsers reads the users and their password hashes from the file at path
+func readUsers(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash", path, n, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// writeUsers replaces the file at path with users, sorted by name
+func writeUsers(path string, users map[string]string) error {
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, user := range names {
+		fmt.Fprintf(&buf, "%s:%s\n", user, users[user])
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// Keep the permissions of an existing file, new ones are only readable by their owner
+	if info, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// updateUsers reads the users file at path, or starts an empty one if it does not exist, lets update change the users
+// and writes them back
+func updateUsers(path string, update func(users map[string]string) error) error {
+	users, err := readUsers(path)
+	if os.IsNotExist(err) {
+		users, err = make(map[string]string), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := update(users); err != nil {
+		return err
+	}
+	return writeUsers(path, users)
+}
+
+// readPassword returns password, or, if it is empty, a line read from stdin, keeping passwords out of the shell history
+func readPassword(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	password = strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	return password, nil
+}
+
+// validUsername returns an error if user cannot be stored in a users file, or used as a wg-ui user
+func validUsername(user string) error {
+	if user == "" || strings.ContainsAny(user, ":/\n\r") || strings.TrimSpace(user) != user || strings.HasPrefix(user, "#") {
+		return fmt.Errorf("invalid username: %q", user)
+	}
+	return nil
+}
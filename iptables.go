@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// iptablesNATChain is the chain of the nat table masquerading client traffic, jumped to from POSTROUTING
+	iptablesNATChain = "WG-UI-POSTROUTING"
+	// iptablesACLChain is the chain of the filter table enforcing the ACLs, jumped to from FORWARD
+	iptablesACLChain = "WG-UI-FORWARD"
+	// iptablesInputACLChain enforces the same ACLs on traffic to the host itself, jumped to from INPUT
+	iptablesInputACLChain = "WG-UI-INPUT"
+)
+
+// iptablesFirewall is the iptables firewall backend, for hosts without nftables. It runs the iptables-legacy and
+// ip6tables-legacy commands, or iptables and ip6tables if those are not installed.
+type iptablesFirewall struct {
+	iptables  string
+	ip6tables string
+}
+
+func newIPTablesFirewall() (*iptablesFirewall, error) {
+	iptables, err := lookPath("iptables-legacy", "iptables")
+	if err != nil {
+		return nil, err
+	}
+	ip6tables, err := lookPath("ip6tables-legacy", "ip6tables")
+	if err != nil {
+		return nil, err
+	}
+	return &iptablesFirewall{iptables: iptables, ip6tables: ip6tables}, nil
+}
+
+// lookPath returns the path of the first of the commands that is installed
+func lookPath(commands ...string) (string, error) {
+	var err error
+	for _, command := range commands {
+		var p string
+		if p, err = exec.LookPath(command); err == nil {
+			return p, nil
+		}
+	}
+	return "", err
+}
+
+// SetNAT replaces the masquerading rule of the nat chains of the server
+func (f *iptablesFirewall) SetNAT(ipv4 bool, ipv6 bool) error {
+	for _, nat := range []struct {
+		command string
+		enabled bool
+	}{{f.iptables, ipv4}, {f.ip6tables, ipv6}} {
+		if !nat.enabled {
+			if err := f.removeChain(nat.command, "nat", "POSTROUTING", iptablesNATChain); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Debugf("Setting up %s masquerading", nat.command)
+		err := f.resetChain(nat.command, "nat", "POSTROUTING", iptablesNATChain)
+		if err == nil {
+			err = runIPTables(nat.command, "-t", "nat", "-A", iptablesNATChain, "-o", *natLink, "-j", "MASQUERADE")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetACLs replaces the rules of the forward and input chains of the server, which hold the same rules
+func (f *iptablesFirewall) SetACLs(entries []aclEntry, closed []string) error {
+	for _, command := range []string{f.iptables, f.ip6tables} {
+		ipv6 := command == f.ip6tables
+		rules := [][]string{{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}}
+		for _, entry := range entries {
+			if (entry.Source.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			for _, rule := range entry.Rules {
+				rules = append(rules, aclRuleArgs(entry.Device, entry.Source, rule)...)
+			}
+			rules = append(rules, []string{"-i", entry.Device, "-s", entry.Source.String(), "-j", "DROP"})
+		}
+		for _, device := range closed {
+			rules = append(rules, []string{"-i", device, "-j", "DROP"})
+		}
+
+		for _, chain := range []struct{ from, name string }{{"FORWARD", iptablesACLChain}, {"INPUT", iptablesInputACLChain}} {
+			if err := f.resetChain(command, "filter", chain.from, chain.name); err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				if err := runIPTables(command, append([]string{"-t", "filter", "-A", chain.name}, rule...)...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the chains of the server
+func (f *iptablesFirewall) Cleanup() error {
+	for _, command := range []string{f.iptables, f.ip6tables} {
+		if err := f.removeChain(command, "nat", "POSTROUTING", iptablesNATChain); err != nil {
+			return err
+		}
+		if err := f.removeChain(command, "filter", "FORWARD", iptablesACLChain); err != nil {
+			return err
+		}
+		if err := f.removeChain(command, "filter", "INPUT", iptablesInputACLChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetChain creates a chain of a table if it does not exist yet, and flushes it otherwise, and makes sure the built
+// in chain jumps to it
+func (f *iptablesFirewall) resetChain(command string, table string, from string, chain string) error {
+	if runIPTables(command, "-t", table, "-n", "-L", chain) != nil {
+		if err := runIPTables(command, "-t", table, "-N", chain); err != nil {
+			return err
+		}
+	} else if err := runIPTables(command, "-t", table, "-F", chain); err != nil {
+		return err
+	}
+
+	if runIPTables(command, "-t", table, "-C", from, "-j", chain) != nil {
+		return runIPTables(command, "-t", table, "-I", from, "-j", chain)
+	}
+	return nil
+}
+
+// removeChain removes a chain of a table, and the jump of the built in chain to it, if they exist
+func (f *iptablesFirewall) removeChain(command string, table string, from string, chain string) error {
+	for runIPTables(command, "-t", table, "-C", from, "-j", chain) == nil {
+		if err := runIPTables(command, "-t", table, "-D", from, "-j", chain); err != nil {
+			return err
+		}
+	}
+	if runIPTables(command, "-t", table, "-n", "-L", chain) != nil {
+		return nil
+	}
+	if err := runIPTables(command, "-t", table, "-F", chain); err != nil {
+		return err
+	}
+	return runIPTables(command, "-t", table, "-X", chain)
+}
+
+// aclRuleArgs returns the arguments of the iptables rules accepting what an ACL rule allows a client source to send,
+// one rule per port range. There are none if the destination is of another IP version than the source.
+func aclRuleArgs(device string, src *net.IPNet, rule ACLRule) [][]string {
+	_, dst, err := net.ParseCIDR(rule.Destination)
+	if err != nil || (dst.IP.To4() == nil) != (src.IP.To4() == nil) {
+		return nil
+	}
+
+	args := []string{"-i", device, "-s", src.String(), "-d", dst.String()}
+	if rule.Protocol != "" {
+		proto := rule.Protocol
+		if proto == "icmp" && src.IP.To4() == nil {
+			proto = "ipv6-icmp"
+		}
+		args = append(args, "-p", proto)
+	}
+
+	if len(rule.Ports) == 0 {
+		return [][]string{append(args, "-j", "ACCEPT")}
+	}
+
+	var rules [][]string
+	for _, port := range rule.Ports {
+		from, to, err := parsePortRange(port)
+		if err != nil {
+			continue
+		}
+		r := append(append([]string{}, args...), "--dport", fmt.Sprintf("%d:%d", from, to), "-j", "ACCEPT")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// runIPTables runs an iptables command, waiting for the xtables lock, and returns its error output as the error
+func runIPTables(command string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(command, append([]string{"-w"}, args...)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", command, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
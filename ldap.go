@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+var errLDAPLogin = errors.New("invalid username or password")
+
+// ldapAuthenticator logs basic auth users in by binding to an LDAP directory, such as Active Directory, as them, and
+// looks up the groups they are members of
+type ldapAuthenticator struct {
+	url       string
+	tlsConfig *tls.Config
+
+	mutex sync.Mutex
+	// logins caches successful logins for --ldap-cache-ttl, as browsers send the credentials with every request
+	logins map[string]ldapLogin
+}
+
+// ldapLogin is a cached login
+type ldapLogin struct {
+	password [sha256.Size]byte
+	user     string
+	groups   []string
+	expires  time.Time
+}
+
+// newLDAPAuthenticator returns the authenticator of the directory at --ldap-url
+func newLDAPAuthenticator() (*ldapAuthenticator, error) {
+	if *ldapUserBaseDN == "" {
+		return nil, fmt.Errorf("--ldap-user-base-dn is required with --ldap-url")
+	}
+
+	u, err := url.Parse(*ldapURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --ldap-url: %w", err)
+	}
+	switch u.Scheme {
+	case "ldaps", "ldapi":
+	case "ldap":
+		if !*ldapStartTLS {
+			log.Warn("Passwords are sent to the LDAP server unencrypted, use an ldaps:// --ldap-url or --ldap-start-tls")
+		}
+	default:
+		return nil, fmt.Errorf("invalid --ldap-url %s, expected ldap://, ldaps:// or ldapi://", *ldapURL)
+	}
+
+	a := &ldapAuthenticator{
+		url: *ldapURL,
+		// The certificate is checked against the host of the URL, which StartTLS does not pick up by itself
+		tlsConfig: &tls.Config{ServerName: u.Hostname()},
+		logins:    make(map[string]ldapLogin),
+	}
+	if *ldapCAFile != "" {
+		pem, err := ioutil.ReadFile(*ldapCAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tlsConfig.RootCAs = x509.NewCertPool()
+		if !a.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *ldapCAFile)
+		}
+	}
+	return a, nil
+}
+
+// dial connects to the directory, bound with --ldap-bind-dn if given, or else anonymously
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.url, ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(*ldapTimeout)
+
+	if *ldapStartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if *ldapBindDN != "" {
+		err = conn.Bind(*ldapBindDN, *ldapBindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("binding as %s: %w", *ldapBindDN, err)
+	}
+	return conn, nil
+}
+
+// authenticate checks the password of user, returning the name identifying them and their groups
+func (a *ldapAuthenticator) authenticate(user, password string) (string, []string, error) {
+	// An empty password would be an unauthenticated bind, which succeeds without checking anything
+	if user == "" || password == "" {
+		return "", nil, errLDAPLogin
+	}
+
+	hash := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mutex.Lock()
+	login, ok := a.logins[user]
+	a.mutex.Unlock()
+	if ok && time.Now().Before(login.expires) && subtle.ConstantTimeCompare(login.password[:], hash[:]) == 1 {
+		return login.user, login.groups, nil
+	}
+
+	name, groups, err := a.login(user, password)
+	if err != nil {
+		return "", nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	for u, l := range a.logins {
+		if now.After(l.expires) {
+			delete(a.logins, u)
+		}
+	}
+	if *ldapCacheTTL > 0 {
+		a.logins[user] = ldapLogin{password: hash, user: name, groups: groups, expires: now.Add(*ldapCacheTTL)}
+	}
+	return name, groups, nil
+}
+
+// login looks up the entry of user, binds as it to check the password and looks up its groups
+func (a *ldapAuthenticator) login(user, password string) (string, []string, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	res, err := conn.Search(ldap.NewSearchRequest(*ldapUserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(*ldapUserFilter, ldap.EscapeFilter(user)), []string{*ldapUsernameAttribute, "memberOf"}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		res, err = &ldap.SearchResult{}, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("searching user: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		log.WithField("user", user).WithField("entries", len(res.Entries)).Debug("LDAP user not found or not unique")
+		return "", nil, errLDAPLogin
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", nil, errLDAPLogin
+		}
+		return "", nil, fmt.Errorf("binding as %s: %w", entry.DN, err)
+	}
+
+	name := entry.GetAttributeValue(*ldapUsernameAttribute)
+	if name == "" {
+		name = user
+	}
+
+	// The user may not be allowed to search the groups, go on as the service account
+	if *ldapBindDN != "" {
+		if err := conn.Bind(*ldapBindDN, *ldapBindPassword); err != nil {
+			return "", nil, fmt.Errorf("binding as %s: %w", *ldapBindDN, err)
+		}
+	}
+	groups, err := a.groups(conn, entry)
+	if err != nil {
+		return "", nil, fmt.Errorf("searching groups: %w", err)
+	}
+	return name, groups, nil
+}
+
+// groups returns the names of the groups under --ldap-group-base-dn whose --ldap-group-filter matches the DN of the
+// user entry, or, without --ldap-group-base-dn, the DNs of the groups in its memberOf attribute, as set by Active
+// Directory. Groups from memberOf may be anywhere in the directory, so they are told apart by their whole DN.
+func (a *ldapAuthenticator) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if *ldapGroupBaseDN == "" {
+		return entry.GetAttributeValues("memberOf"), nil
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(*ldapGroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(*ldapGroupFilter, ldap.EscapeFilter(entry.DN)), []string{*ldapGroupAttribute}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, group := range res.Entries {
+		name := group.GetAttributeValue(*ldapGroupAttribute)
+		if name == "" {
+			name = group.DN
+		}
+		groups = append(groups, name)
+	}
+	return groups, nil
+}
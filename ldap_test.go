@@ -0,0 +1,446 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testDirectory is an in-process LDAP server answering simple binds and searches of its entries
+type testDirectory struct {
+	listener net.Listener
+	// entries are the attributes of each entry, by DN
+	entries map[string]map[string][]string
+	// passwords are the passwords of the entries that may bind
+	passwords map[string]string
+
+	mutex sync.Mutex
+	// binds counts the binds of each DN
+	binds map[string]int
+	// filters are the filters searched for
+	filters []string
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{
+		listener: l,
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {
+				"uid":      {"alice"},
+				"memberOf": {"cn=admins,ou=it,dc=example,dc=com", "cn=contractors,ou=groups,dc=example,dc=com"},
+			},
+			"uid=bob,ou=people,dc=example,dc=com": {
+				"uid":      {"bob"},
+				"memberOf": {"cn=admins,ou=sales,dc=example,dc=com"},
+			},
+			"uid=a*)(uid=*,ou=people,dc=example,dc=com": {
+				"uid": {"a*)(uid=*"},
+			},
+			"cn=admins,ou=groups,dc=example,dc=com": {
+				"cn":     {"admins"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com"},
+			},
+			"cn=contractors,ou=groups,dc=example,dc=com": {
+				"cn":     {"contractors"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			},
+		},
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=example,dc=com":     "secret",
+			"uid=bob,ou=people,dc=example,dc=com":       "hunter2",
+			"uid=a*)(uid=*,ou=people,dc=example,dc=com": "star",
+			"cn=wg-ui,ou=services,dc=example,dc=com":    "service",
+		},
+		binds: make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return d
+}
+
+// url returns the URL of the directory
+func (d *testDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+// bindCount returns how often dn bound successfully
+func (d *testDirectory) bindCount(dn string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.binds[dn]
+}
+
+// searchFilters returns the filters searched for so far
+func (d *testDirectory) searchFilters() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.filters...)
+}
+
+// serve answers the requests of a connection until it is closed or unbound
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{result(ldap.ApplicationBindResponse, d.bind(packetString(op.Children[1]), packetString(op.Children[2])))}
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			responses = []*ber.Packet{result(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError)}
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind returns the result of a simple bind as dn
+func (d *testDirectory) bind(dn, password string) uint16 {
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	if want, ok := d.passwords[dn]; !ok || password == "" || password != want {
+		return ldap.LDAPResultInvalidCredentials
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.binds[dn]++
+	return ldap.LDAPResultSuccess
+}
+
+// search returns the entries under the base DN of a search request matching its filter, and the result
+func (d *testDirectory) search(op *ber.Packet) []*ber.Packet {
+	base := strings.ToLower(packetString(op.Children[0]))
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+	d.mutex.Lock()
+	d.filters = append(d.filters, filter)
+	d.mutex.Unlock()
+
+	var responses []*ber.Packet
+	for dn, attrs := range d.entries {
+		lower := strings.ToLower(dn)
+		if lower != base && !strings.HasSuffix(lower, ","+base) || !matches(op.Children[6], attrs) {
+			continue
+		}
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range attrs {
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attr.AppendChild(set)
+			list.AppendChild(attr)
+		}
+		entry.AppendChild(list)
+		responses = append(responses, entry)
+	}
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// matches returns whether an entry matches a filter of equality matches, presence checks and conjunctions
+func matches(filter *ber.Packet, attrs map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, f := range filter.Children {
+			if !matches(f, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterEqualityMatch:
+		value := packetString(filter.Children[1])
+		for _, v := range attrs[packetString(filter.Children[0])] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	case ldap.FilterPresent:
+		return len(attrs[filter.Data.String()]) != 0
+	}
+	return false
+}
+
+// result returns an LDAP result of the given type
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return p
+}
+
+// packetString returns the string held by a primitive packet
+func packetString(p *ber.Packet) string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	return p.Data.String()
+}
+
+// setLDAPFlags points the LDAP flags at d for the duration of the test
+func setLDAPFlags(t *testing.T, d *testDirectory) {
+	setFlag(t, ldapURL, d.url())
+	setFlag(t, ldapBindDN, "cn=wg-ui,ou=services,dc=example,dc=com")
+	setFlag(t, ldapBindPassword, "service")
+	setFlag(t, ldapUserBaseDN, "ou=people,dc=example,dc=com")
+	setFlag(t, ldapUserFilter, "(uid=%s)")
+	setFlag(t, ldapUsernameAttribute, "uid")
+	setFlag(t, ldapGroupBaseDN, "")
+	setFlag(t, ldapGroupFilter, "(member=%s)")
+	setFlag(t, ldapGroupAttribute, "cn")
+	setDurationFlag(t, ldapTimeout, 5*time.Second)
+	setDurationFlag(t, ldapCacheTTL, time.Minute)
+}
+
+// setDurationFlag sets a duration flag for the duration of the test
+func setDurationFlag(t *testing.T, flag *time.Duration, value time.Duration) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// newTestLDAPAuthenticator returns an authenticator of d
+func newTestLDAPAuthenticator(t *testing.T, d *testDirectory) *ldapAuthenticator {
+	setLDAPFlags(t, d)
+	a, err := newLDAPAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	d := newTestDirectory(t)
+	a := newTestLDAPAuthenticator(t, d)
+
+	for _, test := range []struct {
+		user, password string
+		err            error
+	}{
+		{user: "alice", password: "wrong", err: errLDAPLogin},
+		{user: "alice", password: "", err: errLDAPLogin},
+		{user: "", password: "secret", err: errLDAPLogin},
+		{user: "carol", password: "secret", err: errLDAPLogin},
+		{user: "alice", password: "secret"},
+	} {
+		user, _, err := a.authenticate(test.user, test.password)
+		if err != test.err {
+			t.Errorf("%s with %q: got error %v, want %v", test.user, test.password, err, test.err)
+		}
+		if err == nil && user != test.user {
+			t.Errorf("%s: got user %s", test.user, user)
+		}
+	}
+}
+
+func TestLDAPEscapedFilter(t *testing.T) {
+	d := newTestDirectory(t)
+	a := newTestLDAPAuthenticator(t, d)
+
+	// Unescaped, the filter would match every user with its password
+	if _, _, err := a.authenticate("*", "secret"); err != errLDAPLogin {
+		t.Errorf("got error %v, want %v", err, errLDAPLogin)
+	}
+	user, _, err := a.authenticate("a*)(uid=*", "star")
+	if err != nil || user != "a*)(uid=*" {
+		t.Errorf("got %s and error %v, want a*)(uid=*", user, err)
+	}
+
+	want := []string{`(uid=\2a)`, `(uid=a\2a\29\28uid=\2a)`}
+	if got := d.searchFilters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got filters %q, want %q", got, want)
+	}
+}
+
+func TestLDAPGroups(t *testing.T) {
+	d := newTestDirectory(t)
+
+	t.Run("memberOf", func(t *testing.T) {
+		a := newTestLDAPAuthenticator(t, d)
+		_, alice, err := a.authenticate("alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"cn=admins,ou=it,dc=example,dc=com", "cn=contractors,ou=groups,dc=example,dc=com"}; !reflect.DeepEqual(alice, want) {
+			t.Errorf("got groups %q, want %q", alice, want)
+		}
+		// Groups of the same name in other OUs are different groups
+		_, bob, err := a.authenticate("bob", "hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"cn=admins,ou=sales,dc=example,dc=com"}; !reflect.DeepEqual(bob, want) {
+			t.Errorf("got groups %q, want %q", bob, want)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		a := newTestLDAPAuthenticator(t, d)
+		setFlag(t, ldapGroupBaseDN, "ou=groups,dc=example,dc=com")
+		_, alice, err := a.authenticate("alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alice) != 2 || !contains(alice, "admins") || !contains(alice, "contractors") {
+			t.Errorf("got groups %q, want admins and contractors", alice)
+		}
+		// Only groups under --ldap-group-base-dn count, not those in memberOf
+		_, bob, err := a.authenticate("bob", "hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"contractors"}; !reflect.DeepEqual(bob, want) {
+			t.Errorf("got groups %q, want %q", bob, want)
+		}
+	})
+}
+
+// contains returns whether list contains s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLDAPCache(t *testing.T) {
+	d := newTestDirectory(t)
+	a := newTestLDAPAuthenticator(t, d)
+	const alice = "uid=alice,ou=people,dc=example,dc=com"
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := a.authenticate("alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.bindCount(alice); n != 1 {
+		t.Errorf("got %d binds within the TTL, want 1", n)
+	}
+
+	// Another password is checked against the directory, not the cache
+	if _, _, err := a.authenticate("alice", "wrong"); err != errLDAPLogin {
+		t.Errorf("got error %v, want %v", err, errLDAPLogin)
+	}
+
+	// Expired logins are checked again
+	a.mutex.Lock()
+	login := a.logins["alice"]
+	login.expires = time.Now().Add(-time.Second)
+	a.logins["alice"] = login
+	a.mutex.Unlock()
+	if _, _, err := a.authenticate("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.bindCount(alice); n != 2 {
+		t.Errorf("got %d binds after the TTL, want 2", n)
+	}
+
+	// Without a TTL, every login is checked
+	a = newTestLDAPAuthenticator(t, d)
+	setDurationFlag(t, ldapCacheTTL, 0)
+	for i := 0; i < 2; i++ {
+		if _, _, err := a.authenticate("alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.bindCount(alice); n != 4 {
+		t.Errorf("got %d binds without a TTL, want 4", n)
+	}
+}
+
+func TestLDAPMaxClients(t *testing.T) {
+	d := newTestDirectory(t)
+	a := newTestLDAPAuthenticator(t, d)
+	oldMax := *maxNumberClientConfig
+	*maxNumberClientConfig = 10
+	t.Cleanup(func() { *maxNumberClientConfig = oldMax })
+
+	limits, err := parseGroupMaxClients([]string{"cn=contractors,ou=groups,dc=example,dc=com=2", "cn=admins,ou=it,dc=example,dc=com=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{groupMaxClients: limits}
+
+	for user, want := range map[string]int{
+		"alice": 0,  // unlimited as an admin, although a contractor too
+		"bob":   10, // admins of another OU are not limited by the group of the same name
+	} {
+		password := map[string]string{"alice": "secret", "bob": "hunter2"}[user]
+		_, groups, err := a.authenticate(user, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.maxClients(groups); got != want {
+			t.Errorf("%s in %q: got max %d clients, want %d", user, groups, got, want)
+		}
+	}
+
+	for _, invalid := range []string{"contractors", "=2", "contractors=-1", "contractors=two"} {
+		if _, err := parseGroupMaxClients([]string{invalid}); err == nil {
+			t.Errorf("%s: got no error", invalid)
+		}
+	}
+}
+
+func TestLDAPURL(t *testing.T) {
+	d := newTestDirectory(t)
+	setLDAPFlags(t, d)
+
+	setFlag(t, ldapURL, "ldaps://ldap.example.com:636")
+	a, err := newLDAPAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.tlsConfig.ServerName != "ldap.example.com" {
+		t.Errorf("got server name %q, want ldap.example.com", a.tlsConfig.ServerName)
+	}
+
+	setFlag(t, ldapURL, "http://ldap.example.com")
+	if _, err := newLDAPAuthenticator(); err == nil {
+		t.Error("got no error for an http:// URL")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"path"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -18,8 +20,27 @@ func main() {
 	kingpin.Command("server", "Start server.").Default()
 	passwdCmd := kingpin.Command("passwd", "Generate password hash.")
 	passwdCmdPassword := passwdCmd.Arg("password", "The password to hash").Required().String()
+	useraddCmd := kingpin.Command("useradd", "Add a user to --auth-basic-users-file, creating it if needed.")
+	useraddCmdUser := useraddCmd.Arg("user", "The user to add").Required().String()
+	useraddCmdPassword := useraddCmd.Arg("password", "The password of the user. Read from stdin if not given").String()
+	usermodCmd := kingpin.Command("usermod", "Change the password of a user of --auth-basic-users-file.")
+	usermodCmdUser := usermodCmd.Arg("user", "The user to change").Required().String()
+	usermodCmdPassword := usermodCmd.Arg("password", "The new password of the user. Read from stdin if not given").String()
+	userdelCmd := kingpin.Command("userdel", "Remove a user from --auth-basic-users-file. The clients of the user are kept.")
+	userdelCmdUser := userdelCmd.Arg("user", "The user to remove").Required().String()
+	restoreCmd := kingpin.Command("restore", "Restore a config generation from the data directory. Lists the generations if none is given.")
+	restoreCmdGeneration := restoreCmd.Arg("generation", "Timestamp or file name of the generation to restore").String()
+	rekeyCmd := kingpin.Command("rekey-storage", "Re-encrypt the stored config, including its generations, from --master-key to a new master key.")
+	rekeyCmdNewMasterKey := rekeyCmd.Flag("new-master-key", "The new master key, in the same format as --master-key. Decrypts the config if empty").Default("").String()
+	rotateServerKeyCmd := kingpin.Command("rotate-server-key", "Schedule a rotation of the server key. Use the admin API instead while the server is running.")
+	rotateServerKeyCmdGrace := rotateServerKeyCmd.Flag("grace", "How long the current key stays in use, letting users fetch configs for the new key").Default("24h").Duration()
+	rotateServerKeyCmdNetwork := rotateServerKeyCmd.Flag("network", "The network whose server key to rotate").Default(defaultNetwork).String()
 	cmd := kingpin.Parse()
 
+	if *configBackups < 0 {
+		log.Fatal("--config-backups must not be negative")
+	}
+
 	switch strings.ToLower(*logLevel) {
 	case "debug":
 		log.SetLevel(log.DebugLevel)
@@ -35,12 +56,136 @@ func main() {
 
 	switch cmd {
 	case "passwd":
-		bytes, err := bcrypt.GenerateFromPassword([]byte(*passwdCmdPassword), 14)
+		bytes, err := bcrypt.GenerateFromPassword([]byte(*passwdCmdPassword), bcryptCost)
 		if err != nil {
 			log.Fatalf("generate password error: %v", err)
 		}
 		log.Infof("Password Hash: %s", string(bytes))
 		return
+	case "useradd", "usermod":
+		if *authBasicUsersFile == "" {
+			log.Fatal("--auth-basic-users-file is required")
+		}
+		user, password := *useraddCmdUser, *useraddCmdPassword
+		if cmd == "usermod" {
+			user, password = *usermodCmdUser, *usermodCmdPassword
+		}
+		if err := validUsername(user); err != nil {
+			log.Fatalf("%s error: %v", cmd, err)
+		}
+		password, err := readPassword(password)
+		if err != nil {
+			log.Fatalf("read password error: %v", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			log.Fatalf("generate password error: %v", err)
+		}
+
+		err = updateUsers(*authBasicUsersFile, func(users map[string]string) error {
+			_, exists := users[user]
+			if cmd == "useradd" && exists {
+				return fmt.Errorf("user %s already exists", user)
+			}
+			if cmd == "usermod" && !exists {
+				return fmt.Errorf("no such user: %s", user)
+			}
+			users[user] = string(hash)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("%s error: %v", cmd, err)
+		}
+		log.Infof("Saved user %s", user)
+		return
+	case "userdel":
+		if *authBasicUsersFile == "" {
+			log.Fatal("--auth-basic-users-file is required")
+		}
+		err := updateUsers(*authBasicUsersFile, func(users map[string]string) error {
+			if _, ok := users[*userdelCmdUser]; !ok {
+				return fmt.Errorf("no such user: %s", *userdelCmdUser)
+			}
+			delete(users, *userdelCmdUser)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("userdel error: %v", err)
+		}
+		log.Infof("Removed user %s", *userdelCmdUser)
+		return
+	case "restore":
+		if *restoreCmdGeneration == "" {
+			generations, err := listBackups(path.Join(*dataDir, "config.json"))
+			if err != nil {
+				log.Fatalf("list generations error: %v", err)
+			}
+			for _, g := range generations {
+				log.Infof("Generation: %s", strings.TrimPrefix(path.Base(g), "config.json."))
+			}
+			return
+		}
+
+		storage, err := newStorage(*storageKind, *dataDir)
+		if err != nil {
+			log.Fatalf("open storage error: %v", err)
+		}
+		err = restoreBackup(storage, *dataDir, *restoreCmdGeneration)
+		storage.Close()
+		if err != nil {
+			log.Fatalf("restore error: %v", err)
+		}
+		return
+	case "rekey-storage":
+		oldWrapper, err := newKeyWrapper(*masterKey)
+		if err != nil {
+			log.Fatalf("load master key error: %v", err)
+		}
+		newWrapper, err := newKeyWrapper(*rekeyCmdNewMasterKey)
+		if err != nil {
+			log.Fatalf("load new master key error: %v", err)
+		}
+
+		storage, err := newStorage(*storageKind, *dataDir)
+		if err != nil {
+			log.Fatalf("open storage error: %v", err)
+		}
+		err = rekey(storage, *dataDir, oldWrapper, newWrapper)
+		storage.Close()
+		if err != nil {
+			log.Fatalf("rekey error: %v", err)
+		}
+		log.Info("Re-encrypted storage, restart the server with the new master key")
+		return
+	case "rotate-server-key":
+		wrapper, err := newKeyWrapper(*masterKey)
+		if err != nil {
+			log.Fatalf("load master key error: %v", err)
+		}
+		storage, err := newStorage(*storageKind, *dataDir)
+		if err != nil {
+			log.Fatalf("open storage error: %v", err)
+		}
+		cfg := NewServerConfig(storage, wrapper)
+		n := cfg.Networks[*rotateServerKeyCmdNetwork]
+		if n == nil {
+			storage.Close()
+			log.Fatalf("rotate server key error: no such network: %s", *rotateServerKeyCmdNetwork)
+		}
+		err = n.ScheduleKeyRotation(*rotateServerKeyCmdGrace)
+		if err == nil {
+			err = cfg.Write()
+		}
+		storage.Close()
+		if err != nil {
+			log.Fatalf("rotate server key error: %v", err)
+		}
+		if n.NextPublicKey != "" {
+			log.Infof("Server key changes to %s at %s", n.NextPublicKey, n.KeyRotationAt)
+		} else {
+			log.Infof("Server key changed to %s", n.PublicKey)
+		}
+		return
 	case "server":
 		log.Info("Starting")
 		server := NewServer()
@@ -48,6 +193,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		log.Info("Stopped")
 	default:
 		log.Fatal("Unknown command")
 	}
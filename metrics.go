@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	reconfigureDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "wireguard_ui_reconfigure_duration_seconds",
+		Help: "How long writing the config and applying it to WireGuard and the firewall took.",
+	})
+	reconfigureErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wireguard_ui_reconfigure_errors_total",
+		Help: "Errors applying the config, by stage: write, wireguard or firewall.",
+	}, []string{"stage"})
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wireguard_ui_http_requests_total",
+		Help: "HTTP requests to the API and UI routes, by method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	usersDesc = prometheus.NewDesc("wireguard_ui_users",
+		"Number of users.", nil, nil)
+	clientsDesc = prometheus.NewDesc("wireguard_ui_clients",
+		"Number of clients, by network.", []string{"network"}, nil)
+	poolSizeDesc = prometheus.NewDesc("wireguard_ui_pool_addresses",
+		"Number of addresses of an address pool range.", []string{"pool", "network", "range"}, nil)
+	poolUsedDesc = prometheus.NewDesc("wireguard_ui_pool_addresses_used",
+		"Number of addresses of an address pool range allocated to clients.", []string{"pool", "network", "range"}, nil)
+	clientInfoDesc = prometheus.NewDesc("wireguard_ui_client_info",
+		"Always 1, labelled with the name of a client, to be joined with the peer metrics on client.", []string{"network", "user", "client", "name"}, nil)
+	peerLabels        = []string{"network", "user", "client"}
+	peerHandshakeDesc = prometheus.NewDesc("wireguard_ui_peer_last_handshake_age_seconds",
+		"Time since the last handshake of a client, for clients that completed one.", peerLabels, nil)
+	peerReceiveDesc = prometheus.NewDesc("wireguard_ui_peer_receive_bytes_total",
+		"Bytes received from a client.", peerLabels, nil)
+	peerTransmitDesc = prometheus.NewDesc("wireguard_ui_peer_transmit_bytes_total",
+		"Bytes sent to a client.", peerLabels, nil)
+)
+
+// stateCollector exposes the users, clients, pools and WireGuard peers of the server, read when scraped
+type stateCollector struct {
+	s *Server
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+	ch <- clientsDesc
+	ch <- poolSizeDesc
+	ch <- poolUsedDesc
+	ch <- clientInfoDesc
+	ch <- peerHandshakeDesc
+	ch <- peerReceiveDesc
+	ch <- peerTransmitDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(len(s.Config.Users)))
+
+	clients := make(map[string]int)
+	for name := range s.networks {
+		clients[name] = 0
+	}
+	for _, cfg := range s.Config.Users {
+		for _, client := range cfg.Clients {
+			clients[client.Network]++
+		}
+	}
+	for network, n := range clients {
+		ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(n), network)
+	}
+	// Names can be changed by their users, they are kept out of the labels of the other series so as not to split them
+	for user, cfg := range s.Config.Users {
+		for id, client := range cfg.Clients {
+			ch <- prometheus.MustNewConstMetric(clientInfoDesc, prometheus.GaugeValue, 1, client.Network, user, id, client.Name)
+		}
+	}
+
+	for name, pool := range s.Config.Pools {
+		for _, cidr := range pool.Ranges {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(rangeSize(ipNet)), name, pool.network(), cidr)
+			ch <- prometheus.MustNewConstMetric(poolUsedDesc, prometheus.GaugeValue, float64(s.Config.countIPs(pool.network(), ipNet)), name, pool.network(), cidr)
+		}
+	}
+
+	peers, err := s.peers()
+	if err != nil {
+		log.Error("Error reading WireGuard peers: ", err)
+		return
+	}
+	now := time.Now()
+	for user, cfg := range s.Config.Users {
+		for id, client := range cfg.Clients {
+			peer, ok := peers[client.PublicKey]
+			if !ok {
+				continue
+			}
+			labels := []string{client.Network, user, id}
+			if !peer.LastHandshakeTime.IsZero() {
+				ch <- prometheus.MustNewConstMetric(peerHandshakeDesc, prometheus.GaugeValue, now.Sub(peer.LastHandshakeTime).Seconds(), labels...)
+			}
+			ch <- prometheus.MustNewConstMetric(peerReceiveDesc, prometheus.CounterValue, float64(peer.ReceiveBytes), labels...)
+			ch <- prometheus.MustNewConstMetric(peerTransmitDesc, prometheus.CounterValue, float64(peer.TransmitBytes), labels...)
+		}
+	}
+}
+
+// startMetrics serves the metrics on --metrics-listen-address, returning the server, or nil if it is empty
+func (s *Server) startMetrics() *http.Server {
+	if *metricsListenAddr == "" {
+		return nil
+	}
+	prometheus.MustRegister(stateCollector{s})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:    *metricsListenAddr,
+		Handler: mux,
+	}
+
+	log.WithField("metricsListenAddr", *metricsListenAddr).Info("Starting metrics server")
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.WithError(err).Error("Error serving metrics")
+		}
+	}()
+	return srv
+}
+
+// metricsRouter is a router counting the requests to each of its routes
+type metricsRouter struct {
+	*httprouter.Router
+}
+
+// Handle registers a handler, counting its requests by the path it is registered with
+func (r metricsRouter) Handle(method, path string, handle httprouter.Handle) {
+	r.Router.Handle(method, path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handle(sw, req, ps)
+		httpRequests.WithLabelValues(method, path, strconv.Itoa(sw.status)).Inc()
+	})
+}
+
+func (r metricsRouter) GET(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodGet, path, handle)
+}
+
+func (r metricsRouter) PUT(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPut, path, handle)
+}
+
+func (r metricsRouter) POST(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPost, path, handle)
+}
+
+func (r metricsRouter) DELETE(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodDelete, path, handle)
+}
+
+// statusWriter remembers the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
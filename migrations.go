@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration upgrades a config to Version, returning a description of every change made
+type migration struct {
+	Version     int
+	Description string
+	Migrate     func(cfg *ServerConfig) ([]string, error)
+}
+
+// migrations lists every change of the config schema, ordered by version. Add new migrations to the end.
+var migrations = []migration{
+	{1, "Set the MTU of clients created before it was configurable", migrateClientMTU},
+	{2, "Move the server key and all clients to the default network", migrateNetworks},
+}
+
+// currentSchemaVersion is the config schema version this binary writes
+func currentSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// migrate upgrades cfg to the current schema version, writing a config generation to dir before changing anything.
+// It returns whether cfg was changed.
+func (cfg *ServerConfig) migrate(dir string) (bool, error) {
+	if cfg.SchemaVersion > currentSchemaVersion() {
+		return false, fmt.Errorf("config schema version %d is newer than version %d supported by this binary", cfg.SchemaVersion, currentSchemaVersion())
+	}
+	if cfg.SchemaVersion == currentSchemaVersion() {
+		return false, nil
+	}
+
+	backup, err := writeBackup(dir, cfg)
+	if err != nil {
+		return false, fmt.Errorf("backup before migration: %w", err)
+	}
+	log.Infof("Migrating config from schema version %d to %d, previous config saved as: %s", cfg.SchemaVersion, currentSchemaVersion(), backup)
+
+	for _, m := range migrations {
+		if m.Version <= cfg.SchemaVersion {
+			continue
+		}
+
+		logger := log.WithField("version", m.Version)
+		logger.Info("Applying migration: ", m.Description)
+		changes, err := m.Migrate(cfg)
+		if err != nil {
+			return false, fmt.Errorf("migration to version %d: %w", m.Version, err)
+		}
+		for _, c := range changes {
+			logger.Info(c)
+		}
+		cfg.SchemaVersion = m.Version
+	}
+	return true, nil
+}
+
+func migrateClientMTU(cfg *ServerConfig) ([]string, error) {
+	migrationMTU := *wgPeerMtu
+	if err := verifyLinkMTU(migrationMTU); err != nil {
+		log.WithError(err).Warnf("Invalid peer MTU, migration MTU is set to %d", wgDefaultMtu)
+		migrationMTU = wgDefaultMtu
+	}
+
+	var changes []string
+	for _, user := range cfg.Users {
+		for id, client := range user.Clients {
+			if client.MTU == 0 {
+				client.MTU = migrationMTU
+				changes = append(changes, fmt.Sprintf("Set MTU of client %s of user %s to %d", id, user.Name, migrationMTU))
+			}
+		}
+	}
+	return changes, nil
+}
+
+func migrateNetworks(cfg *ServerConfig) ([]string, error) {
+	var changes []string
+	if cfg.PrivateKey != "" {
+		if cfg.Networks == nil {
+			cfg.Networks = make(map[string]*NetworkConfig)
+		}
+		cfg.Networks[defaultNetwork] = &NetworkConfig{
+			PrivateKey:     cfg.PrivateKey,
+			PublicKey:      cfg.PublicKey,
+			NextPrivateKey: cfg.NextPrivateKey,
+			NextPublicKey:  cfg.NextPublicKey,
+			KeyRotationAt:  cfg.KeyRotationAt,
+			KeyRotatedAt:   cfg.KeyRotatedAt,
+		}
+		cfg.PrivateKey = ""
+		cfg.PublicKey = ""
+		cfg.NextPrivateKey = ""
+		cfg.NextPublicKey = ""
+		cfg.KeyRotationAt = ""
+		cfg.KeyRotatedAt = ""
+		changes = append(changes, fmt.Sprintf("Moved server key %s to network %s", cfg.Networks[defaultNetwork].PublicKey, defaultNetwork))
+	}
+
+	for _, user := range cfg.Users {
+		for id, client := range user.Clients {
+			if client.Network == "" {
+				client.Network = defaultNetwork
+				changes = append(changes, fmt.Sprintf("Moved client %s of user %s to network %s", id, user.Name, defaultNetwork))
+			}
+		}
+	}
+	return changes, nil
+}
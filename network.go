@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// network is a WireGuard interface of the server, with its client IP ranges parsed and the allocator handing out
+// addresses from them
+type network struct {
+	name string
+	*NetworkConfig
+	ipRanges  []ipRange
+	allocator *ipAllocator
+}
+
+// newNetwork returns the running state of a network of cfg
+func newNetwork(cfg *ServerConfig, name string, reserved []*net.IPNet) (*network, error) {
+	ranges, err := parseIPRanges(cfg.Networks[name].IPRanges)
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %w", name, err)
+	}
+
+	return &network{
+		name:          name,
+		NetworkConfig: cfg.Networks[name],
+		ipRanges:      ranges,
+		allocator:     newIPAllocator(cfg, name, ranges, reserved, *ipReuseCooldown),
+	}, nil
+}
+
+// parseIPRanges parses client IP CIDRs, of which at least one must be IPv4
+func parseIPRanges(cidrs []string) ([]ipRange, error) {
+	var ranges []ipRange
+	hasIPv4 := false
+	for _, cidr := range cidrs {
+		ipAddr, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("ipAddr: %s  ipNet: %s", ipAddr, ipNet)
+		r := ipRange{cidr: cidr, serverIP: ipAddr, IPNet: ipNet}
+		if !r.hasClientAddress() {
+			return nil, fmt.Errorf("client IP range %s is too small for the server and a client", cidr)
+		}
+		hasIPv4 = hasIPv4 || !r.isIPv6()
+		ranges = append(ranges, r)
+	}
+	if !hasIPv4 {
+		return nil, fmt.Errorf("at least one IPv4 client IP range is required")
+	}
+	return ranges, nil
+}
+
+// applyDefaultNetwork configures the default network from the command line flags, creating it if it does not exist
+// yet. It returns whether the config changed.
+func applyDefaultNetwork(cfg *ServerConfig) (bool, error) {
+	n := cfg.Networks[defaultNetwork]
+	if n == nil {
+		var err error
+		n, err = newNetworkConfig()
+		if err != nil {
+			return false, err
+		}
+		cfg.Networks[defaultNetwork] = n
+		log.Info("Created default network with public key: ", n.PublicKey)
+	}
+
+	before := *n
+	n.Device = *wgLinkName
+	n.ListenPort = *wgListenPort
+	n.IPRanges = *clientIPRanges
+	n.Endpoint = *wgEndpoint
+	n.AllowedIPs = *wgAllowedIPs
+	return !reflect.DeepEqual(before, *n), nil
+}
+
+// hasIPv6 returns whether clients of the network get IPv6 addresses
+func (n *network) hasIPv6() bool {
+	for _, r := range n.ipRanges {
+		if r.isIPv6() {
+			return true
+		}
+	}
+	return false
+}
+
+// withinIPRanges returns whether ipNet is part of one of the client IP ranges of the network
+func (n *network) withinIPRanges(ipNet *net.IPNet) bool {
+	ones, _ := ipNet.Mask.Size()
+	for _, r := range n.ipRanges {
+		rangeOnes, _ := r.Mask.Size()
+		if r.isIPv6() == (ipNet.IP.To4() == nil) && r.Contains(ipNet.IP) && ones >= rangeOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedNetworks returns the networks ordered by name
+func (s *Server) sortedNetworks() []*network {
+	networks := make([]*network, 0, len(s.networks))
+	for _, n := range s.networks {
+		networks = append(networks, n)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].name < networks[j].name
+	})
+	return networks
+}
+
+// networkOf returns the network named in the request, or the default network if none is
+func (s *Server) networkOf(ps httprouter.Params) *network {
+	if name := ps.ByName("net"); name != "" {
+		return s.networks[name]
+	}
+	return s.networks[defaultNetwork]
+}
+
+// withNetwork responds with 404 Not Found to requests for a network that does not exist
+func (s *Server) withNetwork(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		s.mutex.RLock()
+		n := s.networkOf(ps)
+		s.mutex.RUnlock()
+		if n == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		handler(w, r, ps)
+	}
+}
+
+// clientOf returns the client named in the request, or nil if the user has no such client or if it is not part of
+// the network named in the request
+func clientOf(usercfg *UserConfig, ps httprouter.Params) *ClientConfig {
+	client := usercfg.Clients[ps.ByName("client")]
+	if client == nil || (ps.ByName("net") != "" && client.Network != ps.ByName("net")) {
+		return nil
+	}
+	return client
+}
+
+// initNetwork creates the WireGuard device of a network, with the server addresses, and brings it up
+func (s *Server) initNetwork(n *network) error {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = n.Device
+
+	link := wgLink{
+		attrs: &attrs,
+	}
+
+	log.Debug("Adding wireguard device: ", n.Device)
+	err := netlink.LinkAdd(&link)
+	if os.IsExist(err) {
+		existing, err := netlink.LinkByName(n.Device)
+		if err != nil {
+			return err
+		}
+		if existing.Type() != "wireguard" {
+			return fmt.Errorf("device %s exists and is not a WireGuard device", n.Device)
+		}
+		log.Infof("WireGuard interface %s already exists. Reusing.", n.Device)
+	} else if err != nil {
+		return err
+	}
+
+	for _, r := range n.ipRanges {
+		log.Debug("Adding ip address to wireguard device: ", r.cidr)
+		addr, _ := netlink.ParseAddr(r.cidr)
+		err = netlink.AddrAdd(&link, addr)
+		if os.IsExist(err) {
+			log.Infof("WireGuard interface %s already has the requested address: %s", n.Device, r.cidr)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	log.Debug("Setting link MTU: ", *wgServerMtu)
+	err = netlink.LinkSetMTU(&link, *wgServerMtu)
+	if err != nil {
+		log.Error("Error setting link MTU: ", n.Device)
+		return err
+	}
+
+	log.Debug("Bringing up wireguard device: ", n.Device)
+	err = netlink.LinkSetUp(&link)
+	if err != nil {
+		log.Error("Error bringing up device: ", n.Device)
+		return err
+	}
+	return nil
+}
+
+// removeNetwork deletes the WireGuard device of a network
+func (s *Server) removeNetwork(n *network) error {
+	link, err := netlink.LinkByName(n.Device)
+	if err != nil {
+		return err
+	}
+	if link.Type() != "wireguard" {
+		return fmt.Errorf("device %s is not a WireGuard device, not deleting it", n.Device)
+	}
+	log.Debug("Deleting wireguard device: ", n.Device)
+	return netlink.LinkDel(link)
+}
+
+// discardNetwork undoes initNetwork for a network that could not be created: its device is deleted, with the server
+// addresses on it, unless it existed before, and its allocator gives back the server addresses
+func (s *Server) discardNetwork(n *network, existed bool) {
+	if !existed {
+		if err := s.removeNetwork(n); err != nil {
+			log.WithError(err).Error("Error deleting device: ", n.Device)
+		}
+	}
+	for _, r := range n.ipRanges {
+		n.allocator.cancel(r.serverIP)
+	}
+}
+
+// configureNetwork sets the server key and port of the WireGuard device of a network, and makes its peers those of
+// the enabled clients of the network
+func (s *Server) configureNetwork(wg *wgctrl.Client, n *network) error {
+	log.Debugf("Reconfiguring wireguard interface %s", n.Device)
+
+	log.Debug("Adding wireguard private key")
+	key, err := wgtypes.ParseKey(n.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Getting current Wireguard config")
+	currentdev, err := wg.Device(n.Device)
+	if err != nil {
+		return err
+	}
+	currentpeers := currentdev.Peers
+	diffpeers := make([]wgtypes.PeerConfig, 0)
+
+	now := time.Now()
+	peers := make([]wgtypes.PeerConfig, 0)
+	for user, cfg := range s.Config.Users {
+		for id, dev := range cfg.Clients {
+			if dev.Network != n.name {
+				continue
+			}
+			if dev.expired(now) {
+				log.WithFields(log.Fields{"user": user, "client": id}).Debug("Skipping expired wireguard peer")
+				continue
+			}
+			if dev.Disabled {
+				log.WithFields(log.Fields{"user": user, "client": id}).Debug("Skipping disabled wireguard peer")
+				continue
+			}
+
+			pubKey, err := wgtypes.ParseKey(dev.PublicKey)
+			if err != nil {
+				return err
+			}
+
+			psk, _ := wgtypes.ParseKey(dev.PresharedKey)
+			allowedIPs := []net.IPNet{*netlink.NewIPNet(dev.IP)}
+			if dev.IPv6 != nil {
+				allowedIPs = append(allowedIPs, *netlink.NewIPNet(dev.IPv6))
+			}
+
+			for _, cidr := range dev.AllowedIPs {
+				allowedIPs = append(allowedIPs, *cidr)
+			}
+			peer := wgtypes.PeerConfig{
+				PublicKey:         pubKey,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        allowedIPs,
+				PresharedKey:      &psk,
+			}
+
+			log.WithFields(log.Fields{"user": user, "client": id, "key": dev.PublicKey, "allowedIPs": peer.AllowedIPs}).Debug("Adding wireguard peer")
+
+			peers = append(peers, peer)
+		}
+	}
+
+	// Determine peers updated and to be removed from WireGuard
+	for _, i := range currentpeers {
+		found := false
+		for _, j := range peers {
+			if i.PublicKey == j.PublicKey {
+				found = true
+				j.UpdateOnly = true
+				diffpeers = append(diffpeers, j)
+				break
+			}
+		}
+		if !found {
+			peertoremove := wgtypes.PeerConfig{
+				PublicKey: i.PublicKey,
+				Remove:    true,
+			}
+			diffpeers = append(diffpeers, peertoremove)
+		}
+	}
+
+	// Determine peers to be added to WireGuard
+	for _, i := range peers {
+		found := false
+		for _, j := range currentpeers {
+			if i.PublicKey == j.PublicKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diffpeers = append(diffpeers, i)
+		}
+	}
+
+	cfg := wgtypes.Config{
+		PrivateKey:   &key,
+		ListenPort:   &n.ListenPort,
+		ReplacePeers: false,
+		Peers:        diffpeers,
+	}
+	return wg.ConfigureDevice(n.Device, cfg)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// nftTable is the name of the nftables tables of the server: an ip and an ip6 table for NAT and an inet table for
+// the ACLs
+const nftTable = "wireguard-ui"
+
+// nftFirewall is the nftables firewall backend
+type nftFirewall struct {
+	ns int
+}
+
+func newNFTablesFirewall() (*nftFirewall, error) {
+	ns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	return &nftFirewall{ns: int(ns)}, nil
+}
+
+// SetNAT replaces the nat tables of the server
+func (f *nftFirewall) SetNAT(ipv4 bool, ipv6 bool) error {
+	conn := nftables.Conn{NetNS: f.ns}
+
+	for _, nat := range []struct {
+		family  nftables.TableFamily
+		enabled bool
+	}{{nftables.TableFamilyIPv4, ipv4}, {nftables.TableFamilyIPv6, ipv6}} {
+		table := conn.AddTable(&nftables.Table{
+			Family: nat.family,
+			Name:   nftTable,
+		})
+		if !nat.enabled {
+			// Adding the table first makes deleting it succeed if it does not exist
+			conn.DelTable(table)
+			continue
+		}
+
+		log.Debugf("Setting up nftables masquerading for family %d", nat.family)
+		conn.FlushTable(table)
+		addMasquerade(&conn, table)
+	}
+
+	return conn.Flush()
+}
+
+// addMasquerade adds the chains to a nat table masquerading traffic leaving through the NAT device
+func addMasquerade(conn *nftables.Conn, nat *nftables.Table) {
+	conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    nat,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityFilter,
+	})
+
+	post := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    nat,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	conn.AddRule(&nftables.Rule{
+		Table: nat,
+		Chain: post,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname(*natLink),
+			},
+			&expr.Masq{},
+		},
+	})
+}
+
+// SetACLs replaces the rules of the forward and input chains of the inet table of the server. The same rules apply to
+// both, so that clients reach the host itself, including the UI, only as far as they may reach other hosts.
+func (f *nftFirewall) SetACLs(entries []aclEntry, closed []string) error {
+	conn := nftables.Conn{NetNS: f.ns}
+
+	table := conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   nftTable,
+	})
+	conn.FlushTable(table)
+
+	// Replies to connections made to clients are always allowed
+	rules := [][]expr.Any{{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}}
+	for _, entry := range entries {
+		for _, rule := range entry.Rules {
+			rules = append(rules, aclRuleExprs(entry.Device, entry.Source, rule)...)
+		}
+		exprs := append(matchDevice(entry.Device), matchPrefix(entry.Source, true)...)
+		rules = append(rules, append(exprs, &expr.Verdict{Kind: expr.VerdictDrop}))
+	}
+	for _, device := range closed {
+		rules = append(rules, append(matchDevice(device), &expr.Verdict{Kind: expr.VerdictDrop}))
+	}
+
+	for _, hook := range []struct {
+		name    string
+		hooknum nftables.ChainHook
+	}{{"forward", nftables.ChainHookForward}, {"input", nftables.ChainHookInput}} {
+		policy := nftables.ChainPolicyAccept
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     hook.name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hook.hooknum,
+			Priority: nftables.ChainPriorityFilter,
+			Policy:   &policy,
+		})
+		for _, exprs := range rules {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+		}
+	}
+
+	return conn.Flush()
+}
+
+// Cleanup deletes the tables of the server
+func (f *nftFirewall) Cleanup() error {
+	conn := nftables.Conn{NetNS: f.ns}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet} {
+		table := conn.AddTable(&nftables.Table{
+			Family: family,
+			Name:   nftTable,
+		})
+		conn.DelTable(table)
+	}
+	return conn.Flush()
+}
+
+// aclRuleExprs returns the expressions of the nftables rules accepting what an ACL rule allows a client source to
+// send, one rule per port range. There are none if the destination is of another IP version than the source.
+func aclRuleExprs(device string, src *net.IPNet, rule ACLRule) [][]expr.Any {
+	_, dst, err := net.ParseCIDR(rule.Destination)
+	if err != nil || (dst.IP.To4() == nil) != (src.IP.To4() == nil) {
+		return nil
+	}
+
+	exprs := append(matchDevice(device), matchPrefix(src, true)...)
+	exprs = append(exprs, matchPrefix(dst, false)...)
+	if rule.Protocol != "" {
+		proto := aclProtocols[rule.Protocol]
+		if proto == unix.IPPROTO_ICMP && src.IP.To4() == nil {
+			proto = unix.IPPROTO_ICMPV6
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+	}
+
+	if len(rule.Ports) == 0 {
+		return [][]expr.Any{append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})}
+	}
+
+	var rules [][]expr.Any
+	for _, port := range rule.Ports {
+		from, to, err := parsePortRange(port)
+		if err != nil {
+			continue
+		}
+		r := append(append([]expr.Any{}, exprs...),
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				FromData: binaryutil.BigEndian.PutUint16(from),
+				ToData:   binaryutil.BigEndian.PutUint16(to),
+			},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matchDevice returns expressions matching packets coming in through a device
+func matchDevice(device string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(device)},
+	}
+}
+
+// matchPrefix returns expressions matching packets from, or to, a network, checking the IP version first
+func matchPrefix(ipNet *net.IPNet, source bool) []expr.Any {
+	family, ip, offset := byte(unix.NFPROTO_IPV4), ipNet.IP.To4(), uint32(16)
+	if source {
+		offset = 12
+	}
+	if ip == nil {
+		family, ip, offset = unix.NFPROTO_IPV6, ipNet.IP.To16(), 24
+		if source {
+			offset = 8
+		}
+	}
+
+	mask := []byte(ipNet.Mask)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: mask, Xor: make([]byte, len(ip))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(ipNet.Mask)},
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcLoginPath starts a login with the OpenID Connect provider
+	oidcLoginPath = "/auth/login"
+	// oidcCallbackPath is where the provider sends users back to after logging in
+	oidcCallbackPath = "/auth/callback"
+	// oidcStateCookie holds the state of a login in progress
+	oidcStateCookie = "wgoidc"
+	// oidcLoginTimeout is how long users have to log in with the provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcAuthenticator logs users in with the authorization code flow of an OpenID Connect provider, using PKCE
+type oidcAuthenticator struct {
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcState is what is needed to complete a login once the provider sends the user back
+type oidcState struct {
+	State    string
+	Nonce    string
+	Verifier string
+	// Redirect is the path the user wanted to go to before logging in
+	Redirect string
+}
+
+// newOIDCAuthenticator discovers the provider given by --oidc-issuer
+func newOIDCAuthenticator(ctx context.Context) (*oidcAuthenticator, error) {
+	provider, err := oidc.NewProvider(ctx, *oidcIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OpenID Connect provider: %w", err)
+	}
+
+	return &oidcAuthenticator{
+		oauth2: oauth2.Config{
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       *oidcScopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: *oidcClientID}),
+	}, nil
+}
+
+// randomString returns a random URL safe string
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcAuth identifies users by their session, sending those without one to the provider to log in. Requests to the
+// API without a session are answered with 401 Unauthorized instead.
+func (s *Server) oidcAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case oidcLoginPath:
+			s.oidcLogin(w, r)
+			return
+		case oidcCallbackPath:
+			s.oidcCallback(w, r)
+			return
+		}
+
+		sess, err := s.sessionOf(r)
+		if err != nil {
+			log.WithField("path", r.URL.Path).Debug("Request without session")
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, oidcLoginPath+"?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), sessionCtxKey, sess))
+		authenticated(handler, w, r, sess.User, sess.Groups)
+	})
+}
+
+// oidcLogin sends the user to the provider to log in
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	state := oidcState{Redirect: r.URL.Query().Get("redirect")}
+	// Only paths of wg-ui itself are redirected to, not other sites
+	if !strings.HasPrefix(state.Redirect, "/") || strings.HasPrefix(state.Redirect, "//") {
+		state.Redirect = "/"
+	}
+
+	var err error
+	if state.State, err = randomString(); err == nil {
+		if state.Nonce, err = randomString(); err == nil {
+			state.Verifier, err = randomString()
+		}
+	}
+	if err == nil {
+		err = s.setSignedCookie(w, r, oidcStateCookie, state, time.Now().Add(oidcLoginTimeout))
+	}
+	if err != nil {
+		log.Error("Error starting login: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	http.Redirect(w, r, s.oidc.oauth2.AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), http.StatusFound)
+}
+
+// oidcCallback completes a login, starting a session for the user identified by the ID token of the provider
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	if err := s.signedCookie(r, oidcStateCookie, &state); err != nil {
+		log.Warn("Login callback without login in progress: ", err)
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Warnf("Login failed: %s: %s", e, query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	if query.Get("state") != state.State {
+		log.Warn("Login callback with wrong state")
+		http.Error(w, "Login failed", http.StatusBadRequest)
+		return
+	}
+
+	user, groups, err := s.oidc.identify(r.Context(), query.Get("code"), state)
+	if err != nil {
+		log.Warn("Login failed: ", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.startSession(w, r, user, groups); err != nil {
+		log.Error("Error starting session: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.WithField("user", user).Info("Logged in with OpenID Connect")
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+}
+
+// identify exchanges an authorization code for an ID token, and returns the user and groups it names
+func (a *oidcAuthenticator) identify(ctx context.Context, code string, state oidcState) (string, []string, error) {
+	token, err := a.oauth2.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", state.Verifier))
+	if err != nil {
+		return "", nil, fmt.Errorf("exchanging code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, fmt.Errorf("no ID token in token response")
+	}
+	idToken, err := a.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("verifying ID token: %w", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return "", nil, fmt.Errorf("ID token with wrong nonce")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+	user, _ := claims[*oidcUsernameClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("ID token without %s claim", *oidcUsernameClaim)
+	}
+	// Providers letting users set their address without confirming it would let them pose as whoever owns it
+	if *oidcUsernameClaim == "email" && !emailVerified(claims["email_verified"]) {
+		return "", nil, fmt.Errorf("ID token with unverified email %s", user)
+	}
+
+	var groups []string
+	if list, ok := claims[*oidcGroupsClaim].([]interface{}); ok {
+		for _, g := range list {
+			if group, ok := g.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return user, groups, nil
+}
+
+// emailVerified returns whether the email_verified claim is true, which some providers, like Amazon Cognito, send as a
+// string
+func emailVerified(claim interface{}) bool {
+	switch v := claim.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testProvider is an OpenID Connect provider issuing ID tokens with the claims set by the test for any code
+type testProvider struct {
+	*httptest.Server
+	signer jose.Signer
+
+	mutex sync.Mutex
+	// claims are added to those of each ID token, overriding the defaults
+	claims map[string]interface{}
+	// form is the last token request
+	form url.Values
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{signer: signer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.mutex.Lock()
+		p.form = r.PostForm
+		claims := map[string]interface{}{
+			"iss":            p.URL,
+			"aud":            "wg-ui",
+			"sub":            "1234",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "alice@example.com",
+			"email_verified": true,
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		p.mutex.Unlock()
+
+		idToken, err := jwt.Signed(p.signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// setClaims sets the claims added to the ID tokens issued from now on
+func (p *testProvider) setClaims(claims map[string]interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.claims = claims
+}
+
+// tokenRequest returns the last token request
+func (p *testProvider) tokenRequest() url.Values {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.form
+}
+
+// setFlag sets a flag for the duration of the test
+func setFlag(t *testing.T, flag *string, value string) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// newOIDCTestServer returns a server logging users in with p
+func newOIDCTestServer(t *testing.T, p *testProvider) *Server {
+	setFlag(t, oidcIssuer, p.URL)
+	setFlag(t, oidcClientID, "wg-ui")
+	setFlag(t, oidcRedirectURL, "https://vpn.example.com"+oidcCallbackPath)
+	setFlag(t, oidcUsernameClaim, "email")
+	setFlag(t, oidcGroupsClaim, "groups")
+	// Flags are not parsed in tests, leaving sessions without a lifetime
+	lifetime := *sessionLifetime
+	*sessionLifetime = time.Hour
+	t.Cleanup(func() { *sessionLifetime = lifetime })
+
+	a, err := newOIDCAuthenticator(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{sessionKey: []byte("test"), oidc: a}
+}
+
+// startLogin starts a login, returning the state cookie and the state it holds
+func startLogin(t *testing.T, s *Server, redirect string) (*http.Cookie, oidcState, *url.URL) {
+	w := httptest.NewRecorder()
+	s.oidcAuth(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, oidcLoginPath+"?redirect="+url.QueryEscape(redirect), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", w.Code, http.StatusFound)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login: no state cookie")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	var state oidcState
+	if err := s.signedCookie(r, oidcStateCookie, &state); err != nil {
+		t.Fatal(err)
+	}
+	return cookie, state, location
+}
+
+// callback completes a login with the given state and code
+func callback(s *Server, cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, oidcCallbackPath+"?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.oidcAuth(nil).ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCLoginRedirect(t *testing.T) {
+	s := newOIDCTestServer(t, newTestProvider(t))
+
+	for redirect, want := range map[string]string{
+		"":                         "/",
+		"/":                        "/",
+		"/clients/1?x=y":           "/clients/1?x=y",
+		"//evil.example.com/":      "/",
+		"https://evil.example.com": "/",
+		"evil.example.com":         "/",
+	} {
+		_, state, _ := startLogin(t, s, redirect)
+		if state.Redirect != want {
+			t.Errorf("redirect %q: got %q, want %q", redirect, state.Redirect, want)
+		}
+	}
+}
+
+func TestOIDCLoginChallenge(t *testing.T) {
+	s := newOIDCTestServer(t, newTestProvider(t))
+
+	_, state, location := startLogin(t, s, "/")
+	query := location.Query()
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	if got, want := query.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(challenge[:]); got != want {
+		t.Errorf("got code_challenge %q, want %q", got, want)
+	}
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		t.Errorf("got code_challenge_method %q, want S256", got)
+	}
+	if query.Get("state") != state.State || query.Get("nonce") != state.Nonce {
+		t.Errorf("got state %q and nonce %q, want %q and %q", query.Get("state"), query.Get("nonce"), state.State, state.Nonce)
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCTestServer(t, p)
+
+	cookie, state, _ := startLogin(t, s, "/clients")
+	p.setClaims(map[string]interface{}{"nonce": state.Nonce, "groups": []string{"vpn", "admins"}})
+	w := callback(s, cookie, state.State, "code")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/clients" {
+		t.Fatalf("got status %d to %q, want %d to /clients", w.Code, w.Header().Get("Location"), http.StatusFound)
+	}
+	if got := p.tokenRequest().Get("code_verifier"); got != state.Verifier {
+		t.Errorf("got code_verifier %q, want %q", got, state.Verifier)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			r.AddCookie(c)
+		}
+	}
+	sess, err := s.sessionOf(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.User != "alice@example.com" || !reflect.DeepEqual(sess.Groups, []string{"vpn", "admins"}) {
+		t.Errorf("got session of %s in %v, want alice@example.com in [vpn admins]", sess.User, sess.Groups)
+	}
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCTestServer(t, p)
+
+	cookie, state, _ := startLogin(t, s, "/")
+	p.setClaims(map[string]interface{}{"nonce": state.Nonce})
+	w := callback(s, cookie, "other", "code")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if p.tokenRequest() != nil {
+		t.Error("code exchanged despite the wrong state")
+	}
+}
+
+func TestOIDCCallbackNonceMismatch(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCTestServer(t, p)
+
+	cookie, state, _ := startLogin(t, s, "/")
+	p.setClaims(map[string]interface{}{"nonce": "other"})
+	w := callback(s, cookie, state.State, "code")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			t.Error("session started despite the wrong nonce")
+		}
+	}
+}
+
+func TestOIDCIdentifyClaims(t *testing.T) {
+	p := newTestProvider(t)
+	s := newOIDCTestServer(t, p)
+
+	for _, test := range []struct {
+		name          string
+		usernameClaim string
+		claims        map[string]interface{}
+		user          string
+		groups        []string
+		err           bool
+	}{
+		{name: "email", usernameClaim: "email", user: "alice@example.com"},
+		{name: "email verified as string", usernameClaim: "email", claims: map[string]interface{}{"email_verified": "true"}, user: "alice@example.com"},
+		{name: "email not verified", usernameClaim: "email", claims: map[string]interface{}{"email_verified": false}, err: true},
+		{name: "email without verified claim", usernameClaim: "email", claims: map[string]interface{}{"email_verified": nil}, err: true},
+		{name: "other claim", usernameClaim: "preferred_username", claims: map[string]interface{}{"preferred_username": "alice", "email_verified": false}, user: "alice"},
+		{name: "missing claim", usernameClaim: "preferred_username", err: true},
+		{name: "groups", usernameClaim: "email", claims: map[string]interface{}{"groups": []interface{}{"vpn", 1, "admins"}}, user: "alice@example.com", groups: []string{"vpn", "admins"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, oidcUsernameClaim, test.usernameClaim)
+			state := oidcState{Nonce: "nonce", Verifier: "verifier"}
+			claims := map[string]interface{}{"nonce": state.Nonce}
+			for k, v := range test.claims {
+				claims[k] = v
+			}
+			p.setClaims(claims)
+
+			user, groups, err := s.oidc.identify(context.Background(), "code", state)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %s, want error", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != test.user || !reflect.DeepEqual(groups, test.groups) {
+				t.Errorf("got %s in %v, want %s in %v", user, groups, test.user, test.groups)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyTrust tells which requests come from the authenticating proxy, and may identify the user with headers
+type proxyTrust struct {
+	networks []*net.IPNet
+	secret   string
+	// clientCA is set if the proxy must present a client certificate signed by it
+	clientCA *x509.CertPool
+}
+
+// newProxyTrust returns the proxy requirements given by --trusted-proxies, --proxy-secret and --proxy-client-ca
+func newProxyTrust() (*proxyTrust, error) {
+	t := &proxyTrust{secret: *proxySecret}
+	for _, list := range *trustedProxies {
+		for _, cidr := range strings.Split(list, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			if !strings.Contains(cidr, "/") {
+				cidr += "/32"
+				if strings.Contains(cidr, ":") {
+					cidr = strings.TrimSuffix(cidr, "/32") + "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+			}
+			t.networks = append(t.networks, ipNet)
+		}
+	}
+
+	if *proxyClientCA != "" {
+		if *tlsCertFile == "" {
+			return nil, fmt.Errorf("--proxy-client-ca requires --tls-cert-file")
+		}
+		pem, err := ioutil.ReadFile(*proxyClientCA)
+		if err != nil {
+			return nil, err
+		}
+		t.clientCA = x509.NewCertPool()
+		if !t.clientCA.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *proxyClientCA)
+		}
+	}
+	return t, nil
+}
+
+// required returns whether any requirement is set. Without any, every request is trusted, as wg-ui is then meant to
+// be reachable through the proxy only.
+func (t *proxyTrust) required() bool {
+	return len(t.networks) > 0 || t.secret != "" || t.clientCA != nil
+}
+
+// trusted returns whether a request comes from the proxy, meeting all requirements
+func (t *proxyTrust) trusted(r *http.Request) bool {
+	if len(t.networks) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		found := false
+		for _, n := range t.networks {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if t.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(*proxySecretHeader)), []byte(t.secret)) != 1 {
+		return false
+	}
+
+	// The certificate was verified against the CA during the handshake if one was presented
+	if t.clientCA != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	return true
+}
+
+// tlsConfig returns the TLS config requesting client certificates from the proxy, or nil if none are required
+func (t *proxyTrust) tlsConfig() *tls.Config {
+	if t.clientCA == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientCAs:  t.clientCA,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+}
+
+// hasIdentityHeaders returns whether a request carries headers identifying the user
+func hasIdentityHeaders(r *http.Request) bool {
+	return r.Header.Get(*authUserHeader) != "" || (*authGroupsHeader != "" && r.Header.Get(*authGroupsHeader) != "")
+}
+
+// checkProxy answers requests carrying identity headers that do not come from the proxy with 403 Forbidden, or, with
+// --untrusted-identity=strip, removes the headers, leaving the request anonymous
+func (s *Server) checkProxy(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasIdentityHeaders(r) || s.proxy.trusted(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		logger := log.WithField("remoteAddr", r.RemoteAddr).WithField("path", r.URL.Path)
+		if *untrustedIdentity == "strip" {
+			logger.Debug("Ignoring identity headers of request not coming from a trusted proxy")
+			r.Header.Del(*authUserHeader)
+			if *authGroupsHeader != "" {
+				r.Header.Del(*authGroupsHeader)
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Warn("Rejecting identity headers of request not coming from a trusted proxy")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
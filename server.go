@@ -4,6 +4,7 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
@@ -12,21 +13,21 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	validator "github.com/fujiwara/go-amzn-oidc/validator"
-	"github.com/google/nftables"
-	"github.com/google/nftables/expr"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/skip2/go-qrcode"
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
 	"golang.org/x/crypto/bcrypt"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -38,21 +39,66 @@ const (
 )
 
 var (
-	dataDir = kingpin.Flag("data-dir", "Directory used for storage").Default("/var/lib/wireguard-ui").String()
+	dataDir       = kingpin.Flag("data-dir", "Directory used for storage").Default("/var/lib/wireguard-ui").String()
+	storageKind   = kingpin.Flag("storage", "How the config is stored in the data directory: a single config.json, a bolt database or a file per user").Default("json").Enum("json", "bolt", "dir")
+	configBackups = kingpin.Flag("config-backups", "Number of config.json generations to keep in the data directory").Default("10").Int()
+	masterKey     = kingpin.Flag("master-key", "Master key encrypting the keys stored in the config: file:<path>, env:<variable> or kms+http(s)://<host>/<key id>. Keys are stored unencrypted if empty").Default("").String()
 
 	listenAddr            = kingpin.Flag("listen-address", "Address to listen to").Default(":8080").String()
+	metricsListenAddr     = kingpin.Flag("metrics-listen-address", "Address to serve Prometheus metrics on at /metrics. Disabled if empty").Default("").String()
 	natEnabled            = kingpin.Flag("nat", "Whether NAT is enabled or not").Default("true").Bool()
 	natLink               = kingpin.Flag("nat-device", "Network interface to masquerade").Default("wlp2s0").String()
-	clientIPRange         = kingpin.Flag("client-ip-range", "Client IP CIDR").Default("172.31.255.0/24").String()
+	nat6Enabled           = kingpin.Flag("nat6", "Whether NAT66 is enabled for IPv6 client ranges or not. If disabled, the ranges must be routed to this host").Default("true").Bool()
+	teardownOnExit        = kingpin.Flag("teardown-on-exit", "Remove the firewall rules and WireGuard devices of the server when it stops. Use --no-teardown-on-exit to keep clients connected while the server restarts").Default("true").Bool()
+	firewallKind          = kingpin.Flag("firewall", "How NAT and ACL rules are installed: nftables, or iptables for hosts without nftables").Default("nftables").Enum("nftables", "iptables")
+	clientIPRanges        = kingpin.Flag("client-ip-range", "Client IP CIDR of the default network. Repeat to add IPv6 ranges, each client gets an address of every IP version").Default("172.31.255.0/24").Strings()
+	reservedIPRanges      = kingpin.Flag("reserved-ip-range", "Client IP CIDR never allocated automatically, but which admins may assign as static addresses. Repeat for several ranges").Strings()
+	ipReuseCooldown       = kingpin.Flag("ip-reuse-cooldown", "How long a released client IP is not allocated again").Default("0").Duration()
 	authUserHeader        = kingpin.Flag("auth-user-header", "Header containing username").Default("X-Forwarded-User").String()
+	authGroupsHeader      = kingpin.Flag("auth-groups-header", "Header containing the comma separated groups of the user").Default("X-Forwarded-Groups").String()
+	adminUsers            = kingpin.Flag("admin-users", "User allowed to manage the clients of all users. Repeat for several users").Strings()
+	adminGroups           = kingpin.Flag("admin-group", "Group whose members are allowed to manage the clients of all users. Repeat for several groups").Strings()
+	trustedProxies        = kingpin.Flag("trusted-proxies", "Comma separated CIDRs of the authenticating proxies allowed to identify users with --auth-user-header and --auth-groups-header. Repeatable").Strings()
+	untrustedIdentity     = kingpin.Flag("untrusted-identity", "What to do with identity headers of requests not coming from a trusted proxy: reject the request with 403 Forbidden, or strip the headers").Default("reject").Enum("reject", "strip")
+	proxySecret           = kingpin.Flag("proxy-secret", "Shared secret the proxy must send in --proxy-secret-header for its identity headers to be trusted").Default("").String()
+	proxySecretHeader     = kingpin.Flag("proxy-secret-header", "Header carrying --proxy-secret").Default("X-Proxy-Secret").String()
+	proxyClientCA         = kingpin.Flag("proxy-client-ca", "CA certificate file the client certificate of the proxy must be signed by for its identity headers to be trusted. Requires --tls-cert-file").Default("").String()
+	tlsCertFile           = kingpin.Flag("tls-cert-file", "Certificate file to serve HTTPS with").Default("").String()
+	tlsKeyFile            = kingpin.Flag("tls-key-file", "Private key file of --tls-cert-file").Default("").String()
+	oidcIssuer            = kingpin.Flag("oidc-issuer", "OpenID Connect issuer URL. If given, users log in with it instead of being identified by --auth-user-header").Default("").String()
+	oidcClientID          = kingpin.Flag("oidc-client-id", "OpenID Connect client ID").Default("").String()
+	oidcClientSecret      = kingpin.Flag("oidc-client-secret", "OpenID Connect client secret, empty for a public client").Default("").String()
+	oidcRedirectURL       = kingpin.Flag("oidc-redirect-url", "URL of /auth/callback of wg-ui, as registered with the OpenID Connect provider").Default("").String()
+	oidcScopes            = kingpin.Flag("oidc-scope", "OpenID Connect scope to request. Repeat for several scopes").Default("openid", "email", "profile").Strings()
+	oidcUsernameClaim     = kingpin.Flag("oidc-username-claim", "ID token claim holding the username").Default("email").String()
+	oidcGroupsClaim       = kingpin.Flag("oidc-groups-claim", "ID token claim holding the groups of the user").Default("groups").String()
+	sessionKey            = kingpin.Flag("session-key", "Secret signing the session cookies. If empty, a random one is used and users log in again after restarts").Default("").String()
+	sessionLifetime       = kingpin.Flag("session-lifetime", "How long users stay logged in").Default("12h").Duration()
 	authBasicUser         = kingpin.Flag("auth-basic-user", "Basic auth static username").Default("").String()
 	authBasicPass         = kingpin.Flag("auth-basic-pass", "Basic auth static password").Default("").String()
+	ldapURL               = kingpin.Flag("ldap-url", "LDAP or Active Directory server checking the basic auth passwords of users, ldap://host:389 or ldaps://host:636").Default("").String()
+	ldapStartTLS          = kingpin.Flag("ldap-start-tls", "Use StartTLS with an ldap:// server").Bool()
+	ldapCAFile            = kingpin.Flag("ldap-ca-file", "CA certificates verifying the LDAP server, the system ones if empty").Default("").String()
+	ldapBindDN            = kingpin.Flag("ldap-bind-dn", "DN of the account searching users and groups, searching anonymously if empty").Default("").String()
+	ldapBindPassword      = kingpin.Flag("ldap-bind-password", "Password of --ldap-bind-dn").Default("").String()
+	ldapUserBaseDN        = kingpin.Flag("ldap-user-base-dn", "DN under which users are searched").Default("").String()
+	ldapUserFilter        = kingpin.Flag("ldap-user-filter", "Filter finding the entry of a user, %s is replaced by the username. Use (sAMAccountName=%s) for Active Directory").Default("(uid=%s)").String()
+	ldapUsernameAttribute = kingpin.Flag("ldap-username-attribute", "Attribute of the user entry identifying the user in wg-ui").Default("uid").String()
+	ldapGroupBaseDN       = kingpin.Flag("ldap-group-base-dn", "DN under which groups are searched. If empty, groups are read from the memberOf attribute of the user").Default("").String()
+	ldapGroupFilter       = kingpin.Flag("ldap-group-filter", "Filter finding the groups of a user, %s is replaced by the DN of the user").Default("(member=%s)").String()
+	ldapGroupAttribute    = kingpin.Flag("ldap-group-attribute", "Attribute of the group entries holding the group name").Default("cn").String()
+	ldapTimeout           = kingpin.Flag("ldap-timeout", "Timeout of LDAP requests").Default("10s").Duration()
+	ldapCacheTTL          = kingpin.Flag("ldap-cache-ttl", "How long a successful LDAP login and the groups found are remembered. 0 checks every request against the server").Default("5m").Duration()
+	authBasicUsersFile    = kingpin.Flag("auth-basic-users-file", "File of basic auth users and their bcrypt password hashes, managed with useradd, userdel and usermod. Each user is identified as themselves").Default("").String()
 	maxNumberClientConfig = kingpin.Flag("max-number-client-config", "Max number of configs an client can use. 0 is unlimited").Default("0").Int()
-
-	wgLinkName   = kingpin.Flag("wg-device-name", "WireGuard network device name").Default("wg0").String()
-	wgListenPort = kingpin.Flag("wg-listen-port", "WireGuard UDP port to listen to").Default("51820").Int()
-	wgEndpoint   = kingpin.Flag("wg-endpoint", "WireGuard endpoint address").Default("127.0.0.1:51820").String()
-	wgAllowedIPs = kingpin.Flag("wg-allowed-ips", "WireGuard client allowed ips").Default("0.0.0.0/0").Strings()
+	groupMaxClients       = kingpin.Flag("group-max-clients", "Max number of configs of the members of a group, as group=number, instead of --max-number-client-config. Repeat for several groups, members of several get the highest. 0 is unlimited").Strings()
+	clientDefaultLifetime = kingpin.Flag("client-default-lifetime", "How long new clients stay valid unless an expiry is given. Users other than admins cannot extend it. 0 is forever").Default("0").Duration()
+	aclDefaultPolicy      = kingpin.Flag("acl-default-policy", "Whether clients without ACL rules may reach everything (accept) or nothing (drop) through the WireGuard device, including the host itself").Default("accept").Enum("accept", "drop")
+
+	wgLinkName   = kingpin.Flag("wg-device-name", "WireGuard network device name of the default network").Default("wg0").String()
+	wgListenPort = kingpin.Flag("wg-listen-port", "WireGuard UDP port of the default network to listen to").Default("51820").Int()
+	wgEndpoint   = kingpin.Flag("wg-endpoint", "WireGuard endpoint address of the default network").Default("127.0.0.1:51820").String()
+	wgAllowedIPs = kingpin.Flag("wg-allowed-ips", "WireGuard client allowed ips of the default network").Default("0.0.0.0/0").Strings()
 	wgDNS        = kingpin.Flag("wg-dns", "WireGuard client DNS server (optional)").Default("").String()
 	wgKeepAlive  = kingpin.Flag("wg-keepalive", "WireGuard Keepalive for peers, defined in seconds (optional)").Default("").String()
 	wgServerMtu  = kingpin.Flag("wg-server-mtu", "WireGuard server MTU").Default("1420").Int()
@@ -66,15 +112,35 @@ var (
 type contextKey string
 
 const key = contextKey("user")
+const groupsKey = contextKey("groups")
+const sessionCtxKey = contextKey("session")
+
+// expiryCheckInterval is how often expired clients are looked for
+const expiryCheckInterval = time.Minute
+
+// shutdownTimeout is how long requests in flight are waited for when stopping
+const shutdownTimeout = 30 * time.Second
 
 // Server is the running server
 type Server struct {
-	serverConfigPath string
-	mutex            sync.RWMutex
-	Config           *ServerConfig
-	ipAddr           net.IP
-	clientIPRange    *net.IPNet
-	assets           http.Handler
+	mutex    sync.RWMutex
+	Config   *ServerConfig
+	networks map[string]*network
+	reserved []*net.IPNet
+	firewall firewall
+	// sessionKey signs the session cookies
+	sessionKey []byte
+	// revoked holds the IDs of the sessions logged out of, until they expire
+	revoked    map[string]int64
+	revokedMux sync.Mutex
+	oidc       *oidcAuthenticator
+	proxy      *proxyTrust
+	// users are the basic auth users of --auth-basic-users-file
+	users *usersFile
+	ldap  *ldapAuthenticator
+	// groupMaxClients holds the max number of configs of the members of each group
+	groupMaxClients map[string]int
+	assets          http.Handler
 }
 
 type wgLink struct {
@@ -100,21 +166,72 @@ var assetsFS embed.FS
 
 // NewServer returns an instance of Server which contains both the webserver and the reference to Wireguard
 func NewServer() *Server {
-	ipAddr, ipNet, err := net.ParseCIDR(*clientIPRange)
-	if err != nil {
+	if _, err := parseIPRanges(*clientIPRanges); err != nil {
 		log.Fatal(err)
 	}
-	log.Debugf("ipAddr: %s  ipNet: %s", ipAddr, ipNet)
 
-	err = os.MkdirAll(*dataDir, 0700)
+	var reserved []*net.IPNet
+	for _, cidr := range *reservedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reserved = append(reserved, ipNet)
+	}
+
+	err := os.MkdirAll(*dataDir, 0700)
 	if err != nil {
 		log.WithError(err).Fatalf("Error initializing data directory: %s", *dataDir)
 	}
 
-	cfgPath := path.Join(*dataDir, "config.json")
-	config := NewServerConfig(cfgPath)
+	storage, err := newStorage(*storageKind, *dataDir)
+	if err != nil {
+		log.WithError(err).Fatalf("Error opening %s storage in: %s", *storageKind, *dataDir)
+	}
+
+	if *storageKind != "json" {
+		err = importJSONConfig(storage, path.Join(*dataDir, "config.json"))
+		if err != nil {
+			log.WithError(err).Fatal("Error importing config.json")
+		}
+	}
+
+	wrapper, err := newKeyWrapper(*masterKey)
+	if err != nil {
+		log.WithError(err).Fatal("Error loading master key")
+	}
+
+	config := NewServerConfig(storage, wrapper)
+
+	changed, err := applyDefaultNetwork(config)
+	if err != nil {
+		log.WithError(err).Fatal("Error configuring the default network")
+	}
+	if changed {
+		if err := config.Write(); err != nil {
+			log.WithError(err).Fatal("Error writing config")
+		}
+	}
+
+	networks := make(map[string]*network)
+	for name := range config.Networks {
+		n, err := newNetwork(config, name, reserved)
+		if err != nil {
+			log.Fatal(err)
+		}
+		networks[name] = n
+	}
+
+	// The JSON storage keeps a generation on every write, the others get one per start
+	if *storageKind != "json" && *configBackups > 0 {
+		backup, err := writeBackup(*dataDir, config)
+		if err != nil {
+			log.WithError(err).Fatal("Error writing config generation")
+		}
+		log.Debug("Saved config generation: ", backup)
+	}
 
-	log.Debug("Configuration loaded with public key: ", config.PublicKey)
+	log.Debug("Configuration loaded with public key: ", config.Networks[defaultNetwork].PublicKey)
 
 	var fsys fs.FS = assetsFS
 	if f, err := fs.Sub(fsys, "ui/dist"); err != nil {
@@ -126,12 +243,56 @@ func NewServer() *Server {
 
 	assets := http.FileServer(http.FS(fsys))
 
+	fw, err := newFirewall(*firewallKind)
+	if err != nil {
+		log.WithError(err).Fatalf("Error initializing %s firewall", *firewallKind)
+	}
+
 	s := Server{
-		serverConfigPath: cfgPath,
-		Config:           config,
-		ipAddr:           ipAddr,
-		clientIPRange:    ipNet,
-		assets:           assets,
+		Config:     config,
+		networks:   networks,
+		reserved:   reserved,
+		firewall:   fw,
+		sessionKey: newSessionKey(),
+		revoked:    make(map[string]int64),
+		assets:     assets,
+	}
+
+	s.proxy, err = newProxyTrust()
+	if err != nil {
+		log.WithError(err).Fatal("Error configuring trusted proxies")
+	}
+	if *authBasicUsersFile != "" {
+		s.users, err = newUsersFile(*authBasicUsersFile)
+		if err != nil {
+			log.WithError(err).Fatal("Error reading users file")
+		}
+	}
+
+	if *ldapURL != "" {
+		s.ldap, err = newLDAPAuthenticator()
+		if err != nil {
+			log.WithError(err).Fatal("Error configuring LDAP")
+		}
+	}
+
+	s.groupMaxClients, err = parseGroupMaxClients(*groupMaxClients)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !s.proxy.required() && *oidcIssuer == "" && s.users == nil && s.ldap == nil {
+		log.Warn("Identity headers are trusted from any client, set --trusted-proxies unless --listen-address is only reachable through the proxy")
+	}
+
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" || *oidcRedirectURL == "" {
+			log.Fatal("--oidc-client-id and --oidc-redirect-url are required with --oidc-issuer")
+		}
+		s.oidc, err = newOIDCAuthenticator(context.Background())
+		if err != nil {
+			log.WithError(err).Fatal("Error initializing OpenID Connect")
+		}
 	}
 
 	log.Debug("Server initialized: ", *dataDir)
@@ -139,252 +300,331 @@ func NewServer() *Server {
 }
 
 func (s *Server) enableIPForward() error {
-	p := "/proc/sys/net/ipv4/ip_forward"
+	err := enableSysctl("/proc/sys/net/ipv4/ip_forward", "sys.net.ipv4.ip_forward")
+	if err != nil {
+		return err
+	}
+
+	if s.hasIPv6() {
+		return enableSysctl("/proc/sys/net/ipv6/conf/all/forwarding", "sys.net.ipv6.conf.all.forwarding")
+	}
+	return nil
+}
 
+func enableSysctl(p string, name string) error {
 	content, err := ioutil.ReadFile(p)
 	if err != nil {
 		return err
 	}
 
 	if string(content) == "0\n" {
-		log.Info("Enabling sys.net.ipv4.ip_forward")
+		log.Info("Enabling ", name)
 		return ioutil.WriteFile(p, []byte("1"), 0600)
 	}
 
 	return nil
 }
 
-func (s *Server) initInterface() error {
-	attrs := netlink.NewLinkAttrs()
-	attrs.Name = *wgLinkName
-
-	link := wgLink{
-		attrs: &attrs,
+// hasIPv6 returns whether the clients of any network get IPv6 addresses
+func (s *Server) hasIPv6() bool {
+	for _, n := range s.networks {
+		if n.hasIPv6() {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Debug("Adding wireguard device: ", *wgLinkName)
-	err := netlink.LinkAdd(&link)
-	if os.IsExist(err) {
-		log.Infof("WireGuard interface %s already exists. Reusing.", *wgLinkName)
-	} else if err != nil {
-		return err
+// initInterfaces creates and brings up the WireGuard devices of all networks and sets up NAT
+func (s *Server) initInterfaces() error {
+	for _, n := range s.sortedNetworks() {
+		if err := s.initNetwork(n); err != nil {
+			return err
+		}
 	}
+	return s.initNAT()
+}
 
-	log.Debug("Adding ip address to wireguard device: ", s.clientIPRange)
-	addr, _ := netlink.ParseAddr(*clientIPRange)
-	err = netlink.AddrAdd(&link, addr)
-	if os.IsExist(err) {
-		log.Infof("WireGuard interface %s already has the requested address: ", s.clientIPRange)
-	} else if err != nil {
-		return err
+// initNAT sets up masquerading of the client ranges
+func (s *Server) initNAT() error {
+	log.Debugf("Setting up NAT / IP masquerading using %s", *firewallKind)
+	return s.firewall.SetNAT(*natEnabled, *nat6Enabled && s.hasIPv6())
+}
+
+// assignIPs returns the addresses of a new client of a network: the given ones, which only admins may choose, or free
+// ones of pool, which may be nil
+func (n *network) assignIPs(ip net.IP, ipv6 net.IP, pool *PoolConfig) (net.IP, net.IP, error) {
+	if ip == nil {
+		var err error
+		ip, err = n.allocator.Allocate(false, pool.rangeFor(false))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if err := n.assignIP(ip, false); err != nil {
+		return nil, nil, err
 	}
 
-	log.Debug("Setting link MTU: ", *wgServerMtu)
-	err = netlink.LinkSetMTU(&link, *wgServerMtu)
-	if err != nil {
-		log.Error("Error setting link MTU: ", *wgLinkName)
-		return err
+	if !n.hasIPv6() && ipv6 == nil {
+		return ip, nil, nil
 	}
 
-	log.Debug("Bringing up wireguard device: ", *wgLinkName)
-	err = netlink.LinkSetUp(&link)
+	var err error
+	if ipv6 == nil {
+		ipv6, err = n.allocator.Allocate(true, pool.rangeFor(true))
+	} else {
+		err = n.assignIP(ipv6, true)
+	}
 	if err != nil {
-		log.Error("Error bringing up device: ", *wgLinkName)
-		return err
+		n.allocator.cancel(ip)
+		return nil, nil, err
 	}
+	return ip, ipv6, nil
+}
 
-	if *natEnabled {
-		log.Debug("Adding NAT / IP masquerading using nftables")
-		ns, err := netns.Get()
-		if err != nil {
-			return err
-		}
-
-		conn := nftables.Conn{NetNS: int(ns)}
+// assignIP assigns a static address of the given IP version
+func (n *network) assignIP(ip net.IP, ipv6 bool) error {
+	if (ip.To4() == nil) != ipv6 {
+		return fmt.Errorf("%s: %w", ip, errIPInvalid)
+	}
+	return n.allocator.Assign(ip)
+}
 
-		log.Debug("Flushing nftable rulesets")
-		conn.FlushRuleset()
+// writeIPError responds with the status matching an error assigning an address
+func writeIPError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errIPExhausted):
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case errors.Is(err, errIPInUse):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, errIPInvalid):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 
-		log.Debug("Setting up nftable rules for ip masquerading")
+	err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+	if err != nil {
+		log.Error(err)
+	}
+}
 
-		nat := conn.AddTable(&nftables.Table{
-			Family: nftables.TableFamilyIPv4,
-			Name:   "nat",
-		})
+// assignIPv6 gives an IPv6 address to the clients created before IPv6 ranges were configured
+func (s *Server) assignIPv6() error {
+	assigned := false
+	for user, cfg := range s.Config.Users {
+		for id, dev := range cfg.Clients {
+			n := s.networks[dev.Network]
+			if dev.IPv6 == nil && n != nil && n.hasIPv6() {
+				pool := s.Config.Pools[s.Config.poolFor(n.name, user, cfg.Groups)]
+				ip, err := n.allocator.Allocate(true, pool.rangeFor(true))
+				if err != nil {
+					return err
+				}
+				dev.IPv6 = ip
+				log.WithFields(log.Fields{"user": user, "client": id}).Info("Assigned IPv6 address: ", dev.IPv6)
+				assigned = true
+			}
+		}
+	}
 
-		conn.AddChain(&nftables.Chain{
-			Name:     "prerouting",
-			Table:    nat,
-			Type:     nftables.ChainTypeNAT,
-			Hooknum:  nftables.ChainHookPrerouting,
-			Priority: nftables.ChainPriorityFilter,
-		})
+	if assigned {
+		return s.Config.Write()
+	}
+	return nil
+}
 
-		post := conn.AddChain(&nftables.Chain{
-			Name:     "postrouting",
-			Table:    nat,
-			Type:     nftables.ChainTypeNAT,
-			Hooknum:  nftables.ChainHookPostrouting,
-			Priority: nftables.ChainPriorityNATSource,
-		})
+// reconfigure writes the config and applies it to WireGuard and the firewall. Errors are logged and counted by stage,
+// and the remaining stages are still applied, so that a failing disk does not also take the VPN down. The error
+// writing the config is returned, for handlers to report that the change was not saved; failing to apply it is
+// retried with the next change.
+func (s *Server) reconfigure() error {
+	log.Debug("Reconfiguring")
+	defer prometheus.NewTimer(reconfigureDuration).ObserveDuration()
 
-		conn.AddRule(&nftables.Rule{
-			Table: nat,
-			Chain: post,
-			Exprs: []expr.Any{
-				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     ifname(*natLink),
-				},
-				&expr.Masq{},
-			},
-		})
+	werr := s.Config.Write()
+	if werr != nil {
+		reconfigureErrors.WithLabelValues("write").Inc()
+		log.WithError(werr).Error("Error writing config")
+	}
 
-		if err := conn.Flush(); err != nil {
-			return err
-		}
+	if err := s.configureWireGuard(); err != nil {
+		reconfigureErrors.WithLabelValues("wireguard").Inc()
+		log.WithError(err).Error("Error configuring WireGuard")
 	}
 
-	return nil
+	if err := s.applyACLs(); err != nil {
+		reconfigureErrors.WithLabelValues("firewall").Inc()
+		log.WithError(err).Error("Error applying firewall rules")
+	}
+	return werr
 }
 
-func (s *Server) allocateIP() net.IP {
-	allocated := make(map[string]bool)
-	allocated[s.ipAddr.String()] = true
-	for _, cfg := range s.Config.Users {
-		for _, dev := range cfg.Clients {
-			allocated[dev.IP.String()] = true
+// watchSchedule reconfigures WireGuard whenever a client has expired, removing its peer, and when a scheduled server
+// key rotation is due, until ctx is cancelled. It closes done when it returns.
+func (s *Server) watchSchedule(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	lastCheck := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		if ctx.Err() != nil {
+			return
 		}
-	}
 
-	for ip := s.ipAddr.Mask(s.clientIPRange.Mask); s.clientIPRange.Contains(ip); {
-		for i := len(ip) - 1; i >= 0; i-- {
-			ip[i]++
-			if ip[i] > 0 {
-				break
+		s.mutex.Lock()
+		expired := false
+		for user, cfg := range s.Config.Users {
+			for id, dev := range cfg.Clients {
+				if dev.expired(now) && !dev.expired(lastCheck) {
+					log.WithFields(log.Fields{"user": user, "client": id}).Info("Client expired, removing peer")
+					expired = true
+				}
 			}
 		}
-
-		if !allocated[ip.String()] {
-			log.Debug("Allocated IP: ", ip)
-			return ip
+		rotated := false
+		for _, n := range s.sortedNetworks() {
+			if n.keyRotationDue(now) {
+				log.WithField("network", n.name).Info("Key rotation grace period over, switching to the new server key: ", n.NextPublicKey)
+				n.completeKeyRotation(now)
+				rotated = true
+			}
+		}
+		if rotated {
+			// Errors are logged and counted, writing is retried with the next change
+			s.reconfigure()
+		} else if expired {
+			if err := s.configureWireGuard(); err != nil {
+				reconfigureErrors.WithLabelValues("wireguard").Inc()
+				log.WithError(err).Error("Error removing expired peers")
+			}
 		}
+		lastCheck = now
+		s.mutex.Unlock()
 	}
-
-	log.Fatal("Unable to allocate IP. Address range exhausted")
-	return nil
 }
 
-func (s *Server) reconfigure() {
-	log.Debug("Reconfiguring")
+// shutdown stops accepting requests, waits for those in flight to finish and writes the config. Unless
+// --no-teardown-on-exit is given, the firewall rules and WireGuard devices of the server are removed as well.
+func (s *Server) shutdown(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Error waiting for requests to finish")
+	}
+
+	// Waits for a reconfiguration in progress, and keeps others from starting
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	err := s.Config.Write()
 	if err != nil {
-		log.Fatal(err)
+		log.WithError(err).Error("Error writing config")
 	}
 
-	err = s.configureWireGuard()
-	if err != nil {
-		log.Fatal(err)
+	if *teardownOnExit {
+		log.Info("Removing firewall rules and WireGuard devices")
+		if ferr := s.firewall.Cleanup(); ferr != nil {
+			log.WithError(ferr).Error("Error removing firewall rules")
+			err = ferr
+		}
+		for _, n := range s.sortedNetworks() {
+			if nerr := s.removeNetwork(n); nerr != nil {
+				log.WithError(nerr).Error("Error removing WireGuard device: ", n.Device)
+				err = nerr
+			}
+		}
 	}
-}
 
-func (s *Server) configureWireGuard() error {
-	log.Debugf("Reconfiguring wireguard interface %s", *wgLinkName)
-	wg, err := wgctrl.New()
-	if err != nil {
-		return err
+	if serr := s.Config.storage.Close(); serr != nil {
+		log.WithError(serr).Error("Error closing storage")
+		err = serr
 	}
+	return err
+}
 
-	log.Debug("Adding wireguard private key")
-	key, err := wgtypes.ParseKey(s.Config.PrivateKey)
-	if err != nil {
-		return err
+// verifyExpiry checks an expiry requested for a client expiring at current, empty for new clients and clients that
+// do not expire. Users other than admins may neither remove nor postpone the current expiry, nor extend it beyond the
+// default lifetime.
+func verifyExpiry(r *http.Request, expiresAt string, current string) error {
+	if expiresAt != "" {
+		if _, err := time.Parse(time.RFC3339, expiresAt); err != nil {
+			return fmt.Errorf("invalid expiry: %w", err)
+		}
 	}
 
-	log.Debugf("Getting current Wireguard config")
-	currentdev, err := wg.Device(*wgLinkName)
-	if err != nil {
-		return err
+	if isAdmin(r) {
+		return nil
+	}
+	if currentTime, err := time.Parse(time.RFC3339, current); err == nil {
+		if expiresAt == "" {
+			return fmt.Errorf("only admins may remove the expiry of a client")
+		}
+		t, _ := time.Parse(time.RFC3339, expiresAt)
+		if t.After(currentTime) {
+			return fmt.Errorf("only admins may postpone the expiry of a client")
+		}
 	}
-	currentpeers := currentdev.Peers
-	diffpeers := make([]wgtypes.PeerConfig, 0)
-
-	peers := make([]wgtypes.PeerConfig, 0)
-	for user, cfg := range s.Config.Users {
-		for id, dev := range cfg.Clients {
-			pubKey, err := wgtypes.ParseKey(dev.PublicKey)
-			if err != nil {
-				return err
-			}
-
-			psk, _ := wgtypes.ParseKey(dev.PresharedKey)
-			allowedIPs := make([]net.IPNet, 1+len(dev.AllowedIPs))
-			allowedIPs[0] = *netlink.NewIPNet(dev.IP)
 
-			for i, cidr := range dev.AllowedIPs {
-				allowedIPs[1+i] = *cidr
-			}
-			peer := wgtypes.PeerConfig{
-				PublicKey:         pubKey,
-				ReplaceAllowedIPs: true,
-				AllowedIPs:        allowedIPs,
-				PresharedKey:      &psk,
-			}
+	if *clientDefaultLifetime == 0 {
+		return nil
+	}
 
-			log.WithFields(log.Fields{"user": user, "client": id, "key": dev.PublicKey, "allowedIPs": peer.AllowedIPs}).Debug("Adding wireguard peer")
+	if expiresAt == "" {
+		return fmt.Errorf("clients must expire within %s", *clientDefaultLifetime)
+	}
+	t, _ := time.Parse(time.RFC3339, expiresAt)
+	if t.After(time.Now().Add(*clientDefaultLifetime)) {
+		return fmt.Errorf("clients must expire within %s", *clientDefaultLifetime)
+	}
+	return nil
+}
 
-			peers = append(peers, peer)
-		}
+// configureWireGuard configures the WireGuard devices of all networks
+func (s *Server) configureWireGuard() error {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
 	}
+	defer wg.Close()
 
-	// Determine peers updated and to be removed from WireGuard
-	for _, i := range currentpeers {
-		found := false
-		for _, j := range peers {
-			if i.PublicKey == j.PublicKey {
-				found = true
-				j.UpdateOnly = true
-				diffpeers = append(diffpeers, j)
-				break
-			}
-		}
-		if !found {
-			peertoremove := wgtypes.PeerConfig{
-				PublicKey: i.PublicKey,
-				Remove:    true,
-			}
-			diffpeers = append(diffpeers, peertoremove)
+	for _, n := range s.sortedNetworks() {
+		if err := s.configureNetwork(wg, n); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Determine peers to be added to WireGuard
-	for _, i := range peers {
-		found := false
-		for _, j := range currentpeers {
-			if i.PublicKey == j.PublicKey {
-				found = true
-				break
-			}
+// verifyClientSettings checks the routes, DNS servers, search domains and keepalive of a client, normalizing the
+// routes
+func verifyClientSettings(c *ClientConfig) error {
+	for i, route := range c.Routes {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(route))
+		if err != nil {
+			return fmt.Errorf("invalid route: %w", err)
 		}
-		if !found {
-			diffpeers = append(diffpeers, i)
+		c.Routes[i] = ipNet.String()
+	}
+	for _, dns := range c.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid DNS server: %q", dns)
 		}
 	}
-
-	cfg := wgtypes.Config{
-		PrivateKey:   &key,
-		ListenPort:   wgListenPort,
-		ReplacePeers: false,
-		Peers:        diffpeers,
+	for _, domain := range c.DNSSearch {
+		if domain == "" || strings.ContainsAny(domain, ", \t") {
+			return fmt.Errorf("invalid DNS search domain: %q", domain)
+		}
 	}
-	err = wg.ConfigureDevice(*wgLinkName, cfg)
-	if err != nil {
-		return err
+	if c.PersistentKeepalive != nil && (*c.PersistentKeepalive < 0 || *c.PersistentKeepalive > 65535) {
+		return fmt.Errorf("keepalive must be between 0 and 65535 seconds")
 	}
-
 	return nil
 }
 
@@ -402,7 +642,23 @@ func (s *Server) Start() error {
 		return err
 	}
 
-	err = s.initInterface()
+	err = s.initInterfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range s.sortedNetworks() {
+		if n.keyRotationDue(time.Now()) {
+			log.WithField("network", n.name).Info("Key rotation grace period passed, switching to the new server key: ", n.NextPublicKey)
+			n.completeKeyRotation(time.Now())
+			err = s.Config.Write()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = s.assignIPv6()
 	if err != nil {
 		return err
 	}
@@ -412,19 +668,53 @@ func (s *Server) Start() error {
 		return err
 	}
 
-	router := httprouter.New()
+	err = s.applyACLs()
+	if err != nil {
+		return err
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	watchDone := make(chan struct{})
+	go s.watchSchedule(watchCtx, watchDone)
+
+	router := metricsRouter{httprouter.New()}
 	router.GET("/api/v1/whoami", s.WhoAmI)
-	router.GET("/api/v1/users/:user/clients/:client", s.withAuth(s.GetClient))
-	router.PUT("/api/v1/users/:user/clients/:client", s.withAuth(s.EditClient))
-	router.DELETE("/api/v1/users/:user/clients/:client", s.withAuth(s.DeleteClient))
-	router.GET("/api/v1/users/:user/clients", s.withAuth(s.GetClients))
-	router.POST("/api/v1/users/:user/clients", s.withAuth(s.CreateClient))
+	router.GET("/api/v1/session", s.GetSession)
+	router.DELETE("/api/v1/session", s.withCSRF(s.DeleteSession))
+	router.GET("/api/v1/server", s.GetServerInfo)
+	router.GET("/api/v1/networks", s.GetNetworks)
+	router.GET("/api/v1/networks/:net/server", s.withNetwork(s.GetServerInfo))
+	// The client routes without a network cover the clients of all networks, and create clients in the default one
+	for _, prefix := range []string{"/api/v1", "/api/v1/networks/:net"} {
+		router.GET(prefix+"/users/:user/clients/:client", s.withNetwork(s.withAuth(s.GetClient)))
+		router.PUT(prefix+"/users/:user/clients/:client", s.withNetwork(s.withCSRF(s.withAuth(s.EditClient))))
+		router.DELETE(prefix+"/users/:user/clients/:client", s.withNetwork(s.withCSRF(s.withAuth(s.DeleteClient))))
+		router.POST(prefix+"/users/:user/clients/:client/disable", s.withNetwork(s.withCSRF(s.withAuth(s.DisableClient))))
+		router.POST(prefix+"/users/:user/clients/:client/enable", s.withNetwork(s.withCSRF(s.withAuth(s.EnableClient))))
+		router.POST(prefix+"/users/:user/clients/:client/rotate", s.withNetwork(s.withCSRF(s.withAuth(s.RotateClient))))
+		router.GET(prefix+"/users/:user/clients", s.withNetwork(s.withAuth(s.GetClients)))
+		router.POST(prefix+"/users/:user/clients", s.withNetwork(s.withCSRF(s.withAuth(s.CreateClient))))
+		router.GET(prefix+"/users/:user/clients/:client/status", s.withNetwork(s.withAuth(s.GetClientStatus)))
+		router.GET(prefix+"/users/:user/status", s.withNetwork(s.withAuth(s.GetClientsStatus)))
+	}
+	router.GET("/api/v1/admin/users", s.withAdmin(s.GetUsers))
+	router.PUT("/api/v1/admin/users/:user/acl", s.withCSRF(s.withAdmin(s.SetUserACL)))
+	router.GET("/api/v1/admin/ips", s.withAdmin(s.GetIPs))
+	router.GET("/api/v1/admin/pools", s.withAdmin(s.GetPools))
+	router.PUT("/api/v1/admin/pools/:pool", s.withCSRF(s.withAdmin(s.SetPool)))
+	router.DELETE("/api/v1/admin/pools/:pool", s.withCSRF(s.withAdmin(s.DeletePool)))
+	router.PUT("/api/v1/admin/networks/:net", s.withCSRF(s.withAdmin(s.SetNetwork)))
+	router.DELETE("/api/v1/admin/networks/:net", s.withCSRF(s.withAdmin(s.DeleteNetwork)))
+	router.POST("/api/v1/admin/networks/:net/rotate-key", s.withNetwork(s.withCSRF(s.withAdmin(s.RotateServerKey))))
+	router.DELETE("/api/v1/admin/networks/:net/rotate-key", s.withNetwork(s.withCSRF(s.withAdmin(s.CancelServerKeyRotation))))
+	router.POST("/api/v1/admin/server/rotate-key", s.withCSRF(s.withAdmin(s.RotateServerKey)))
+	router.DELETE("/api/v1/admin/server/rotate-key", s.withCSRF(s.withAdmin(s.CancelServerKeyRotation)))
 
 	if *devUIServer != "" {
 		log.Debug("Serving static assets proxying from development server: ", *devUIServer)
 		devProxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			url, _ := url.Parse(*devUIServer)
-			if strings.HasPrefix(r.URL.Path, "/client/") || r.URL.Path == "/about" {
+			if strings.HasPrefix(r.URL.Path, "/client/") || r.URL.Path == "/about" || r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
 				r.URL.Path = "/"
 			}
 			proxy := httputil.NewSingleHostReverseProxy(url)
@@ -439,17 +729,77 @@ func (s *Server) Start() error {
 		log.Debug("Serving static assets embedded in binary")
 		router.GET("/about", s.Index)
 		router.GET("/client/:client", s.Index)
+		router.GET("/admin", s.Index)
+		router.GET("/admin/users/:user", s.Index)
+		router.GET("/admin/users/:user/newclient", s.Index)
+		router.GET("/admin/users/:user/client/:client", s.Index)
 		router.NotFound = s.assets
 	}
 
 	log.WithField("listenAddr", *listenAddr).Info("Starting server")
 
-	return http.ListenAndServe(*listenAddr, s.basicAuth(s.userFromHeader(router)))
+	handler := s.checkProxy(s.userFromHeader(router))
+	if s.oidc != nil {
+		handler = s.oidcAuth(router)
+	}
+	srv := &http.Server{
+		Addr:      *listenAddr,
+		Handler:   s.basicAuth(handler),
+		TLSConfig: s.proxy.tlsConfig(),
+	}
+
+	metricsSrv := s.startMetrics()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	errs := make(chan error, 1)
+	go func() {
+		if *tlsCertFile != "" {
+			errs <- srv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-errs:
+		log.WithError(err).Error("Error serving HTTP")
+	case sig := <-signals:
+		log.Info("Received ", sig, ", shutting down")
+	}
+
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	// Expiries and key rotations must not reconfigure WireGuard after teardown
+	stopWatching()
+	<-watchDone
+	if serr := s.shutdown(srv); err == nil {
+		err = serr
+	}
+	return err
 }
 
 func (s *Server) basicAuth(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		// Users of the users file or the LDAP directory log in as themselves
+		if s.users != nil || s.ldap != nil {
+			u, p, ok := r.BasicAuth()
+			var user string
+			var groups []string
+			if ok {
+				user, groups, ok = s.checkBasicAuth(u, p)
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			authenticated(handler, w, r, user, groups)
+			return
+		}
+
 		// If we specified a user, require auth
 		if *authBasicUser != "" {
 			u, p, ok := r.BasicAuth()
@@ -465,8 +815,38 @@ func (s *Server) basicAuth(handler http.Handler) http.Handler {
 	})
 }
 
+// checkBasicAuth checks the password of a user of the users file, or else of the LDAP directory, returning the
+// user and groups it identifies
+func (s *Server) checkBasicAuth(user, password string) (string, []string, bool) {
+	logger := log.WithField("user", user)
+	if s.users != nil && (s.ldap == nil || s.users.exists(user)) {
+		if !s.users.authenticate(user, password) {
+			logger.Warn("Failed basic auth login")
+			return "", nil, false
+		}
+		return user, nil, true
+	}
+
+	name, groups, err := s.ldap.authenticate(user, password)
+	if err == errLDAPLogin {
+		logger.Warn("Failed LDAP login")
+		return "", nil, false
+	}
+	if err != nil {
+		logger.Error("Error logging in with LDAP: ", err)
+		return "", nil, false
+	}
+	return name, groups, true
+}
+
 func (s *Server) userFromHeader(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Users identified by basic auth are not overridden by headers
+		if _, ok := r.Context().Value(key).(string); ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
 		user := r.Header.Get(*authUserHeader)
 		if user == "" {
 			log.Debug("Unauthenticated request")
@@ -488,18 +868,31 @@ func (s *Server) userFromHeader(handler http.Handler) http.Handler {
 			}
 		}
 
-		cookie := http.Cookie{
-			Name:  "wguser",
-			Value: user,
-			Path:  "/",
+		var groups []string
+		if *authGroupsHeader != "" {
+			for _, g := range strings.Split(r.Header.Get(*authGroupsHeader), ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					groups = append(groups, g)
+				}
+			}
 		}
-		http.SetCookie(w, &cookie)
 
-		ctx := context.WithValue(r.Context(), key, user)
-		handler.ServeHTTP(w, r.WithContext(ctx))
+		authenticated(handler, w, r, user, groups)
 	})
 }
 
+// authenticated passes a request on to handler as made by user, a member of groups
+func authenticated(handler http.Handler, w http.ResponseWriter, r *http.Request, user string, groups []string) {
+	// Older versions set the user in a plain cookie, which the UI no longer reads
+	if _, err := r.Cookie("wguser"); err == nil {
+		http.SetCookie(w, &http.Cookie{Name: "wguser", Path: "/", MaxAge: -1})
+	}
+
+	ctx := context.WithValue(r.Context(), key, user)
+	ctx = context.WithValue(ctx, groupsKey, groups)
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
 func (s *Server) withAuth(handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		log.Debug("Auth required")
@@ -511,7 +904,7 @@ func (s *Server) withAuth(handler httprouter.Handle) httprouter.Handle {
 			return
 		}
 
-		if user != ps.ByName("user") {
+		if user != ps.ByName("user") && !isAdmin(r) {
 			log.WithField("user", user).WithField("path", r.URL.Path).Warn("Unauthorized access")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -525,7 +918,10 @@ func (s *Server) withAuth(handler httprouter.Handle) httprouter.Handle {
 func (s *Server) WhoAmI(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	user := r.Context().Value(key).(string)
 	log.Debug(user)
-	err := json.NewEncoder(w).Encode(struct{ User string }{user})
+	err := json.NewEncoder(w).Encode(struct {
+		User  string
+		Admin bool
+	}{user, isAdmin(r)})
 	if err != nil {
 		log.Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -536,12 +932,16 @@ func (s *Server) WhoAmI(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 func (s *Server) GetClients(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	user := r.Context().Value(key).(string)
+	user := ps.ByName("user")
 	log.Debug(user)
 	clients := map[string]*ClientConfig{}
 	userConfig := s.Config.Users[user]
 	if userConfig != nil {
-		clients = userConfig.Clients
+		for id, client := range userConfig.Clients {
+			if ps.ByName("net") == "" || client.Network == ps.ByName("net") {
+				clients[id] = client
+			}
+		}
 	}
 
 	err := json.NewEncoder(w).Encode(clients)
@@ -551,60 +951,170 @@ func (s *Server) GetClients(w http.ResponseWriter, r *http.Request, ps httproute
 	}
 }
 
-// Index returns the single-page app
-func (s *Server) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Debug("Serving single-page app from URL: ", r.URL)
-	r.URL.Path = "/"
-	s.assets.ServeHTTP(w, r)
+// serverInfo is what users may know about a network: where to connect to and the public keys of the server,
+// including the state of a key rotation
+type serverInfo struct {
+	Network       string
+	Endpoint      string
+	PublicKey     string
+	NextPublicKey string
+	KeyRotationAt string
+	KeyRotatedAt  string
 }
 
-// GetClient returns a specific client for the current user
-func (s *Server) GetClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func newServerInfo(n *network) serverInfo {
+	return serverInfo{
+		Network:       n.name,
+		Endpoint:      n.Endpoint,
+		PublicKey:     n.PublicKey,
+		NextPublicKey: n.NextPublicKey,
+		KeyRotationAt: n.KeyRotationAt,
+		KeyRotatedAt:  n.KeyRotatedAt,
+	}
+}
+
+// GetServerInfo returns the public keys of the server on a network, including the state of a key rotation
+func (s *Server) GetServerInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	user := r.Context().Value(key).(string)
-	usercfg := s.Config.Users[user]
-	if usercfg == nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	s.writeServerInfo(w, s.networkOf(ps))
+}
+
+func (s *Server) writeServerInfo(w http.ResponseWriter, n *network) {
+	err := json.NewEncoder(w).Encode(newServerInfo(n))
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
 	}
+}
 
-	client := usercfg.Clients[ps.ByName("client")]
-	if client == nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+// GetNetworks returns the public keys of the server on every network, ordered by network name
+func (s *Server) GetNetworks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := make([]serverInfo, 0, len(s.networks))
+	for _, n := range s.sortedNetworks() {
+		infos = append(infos, newServerInfo(n))
+	}
+	err := json.NewEncoder(w).Encode(infos)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Index returns the single-page app
+func (s *Server) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Debug("Serving single-page app from URL: ", r.URL)
+	r.URL.Path = "/"
+	s.assets.ServeHTTP(w, r)
+}
+
+// clientConfig renders the WireGuard config file of a client connecting to the server on a network with the given
+// public key
+func (s *Server) clientConfig(client *ClientConfig, n *network, serverPublicKey string) string {
+	privateKey := client.PrivateKey
+	if privateKey == "" {
+		// The private key is kept on the client only
+		privateKey = "<insert>"
+	}
+
+	address := client.IP.String()
+	if client.IPv6 != nil {
+		address += ", " + client.IPv6.String()
 	}
 
 	interfaceConfig := []string{
 		"[Interface]",
-		"Address = " + client.IP.String(),
-		"PrivateKey = " + client.PrivateKey,
+		"Address = " + address,
+		"PrivateKey = " + privateKey,
+	}
+	// Search domains are added to the servers of the client, or else to those of --wg-dns
+	dns := client.DNS
+	if len(dns) == 0 && *wgDNS != "" {
+		dns = []string{*wgDNS}
 	}
-	if *wgDNS != "" {
-		interfaceConfig = append(interfaceConfig, "DNS = "+*wgDNS)
+	if dns = append(append([]string{}, dns...), client.DNSSearch...); len(dns) > 0 {
+		interfaceConfig = append(interfaceConfig, "DNS = "+strings.Join(dns, ", "))
 	}
 	if client.MTU != wgDefaultMtu {
 		interfaceConfig = append(interfaceConfig, fmt.Sprintf("MTU = %d", client.MTU))
 	}
 
+	routes := n.AllowedIPs
+	if len(client.Routes) > 0 {
+		routes = client.Routes
+	}
+
 	peerConfig := []string{
 		"[Peer]",
-		"PublicKey = " + s.Config.PublicKey,
-		"AllowedIPs = " + strings.Join(*wgAllowedIPs, ","),
-		"Endpoint = " + *wgEndpoint,
+		"PublicKey = " + serverPublicKey,
+		"AllowedIPs = " + strings.Join(routes, ","),
+		"Endpoint = " + n.Endpoint,
 	}
-	if *wgKeepAlive != "" {
+	if client.PersistentKeepalive != nil {
+		if *client.PersistentKeepalive > 0 {
+			peerConfig = append(peerConfig, fmt.Sprintf("PersistentKeepalive = %d", *client.PersistentKeepalive))
+		}
+	} else if *wgKeepAlive != "" {
 		peerConfig = append(peerConfig, "PersistentKeepalive = "+*wgKeepAlive)
 	}
 	if client.PresharedKey != "" {
 		peerConfig = append(peerConfig, "PresharedKey = "+client.PresharedKey)
 	}
 
-	clientConfig := strings.Join(interfaceConfig[:], "\n") + "\n\n" + strings.Join(peerConfig[:], "\n") + "\n"
+	return strings.Join(interfaceConfig[:], "\n") + "\n\n" + strings.Join(peerConfig[:], "\n") + "\n"
+}
+
+// serveClientConfig sends a rendered client config as a file download
+func serveClientConfig(w http.ResponseWriter, client *ClientConfig, clientConfig string) {
+	filename := fmt.Sprintf("%s.conf", filenameRe.ReplaceAllString(client.Name, "_"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Type", "application/config")
+	w.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprint(w, clientConfig)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// GetClient returns a specific client for the current user
+func (s *Server) GetClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	user := ps.ByName("user")
+	usercfg := s.Config.Users[user]
+	if usercfg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	client := clientOf(usercfg, ps)
+	if client == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n := s.networks[client.Network]
+	serverPublicKey := n.PublicKey
+	if r.URL.Query().Get("key") == "next" {
+		if n.NextPublicKey == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		serverPublicKey = n.NextPublicKey
+	}
+	clientConfig := s.clientConfig(client, n, serverPublicKey)
 
 	format := r.URL.Query().Get("format")
 
 	if format == "qrcode" {
+		if client.PrivateKey == "" {
+			log.Debug("No QR code for client without private key: ", client.Name)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		png, err := qrcode.Encode(clientConfig, qrcode.Medium, 220)
 		if err != nil {
 			log.Error(err)
@@ -624,14 +1134,7 @@ func (s *Server) GetClient(w http.ResponseWriter, r *http.Request, ps httprouter
 	}
 
 	if format == "config" {
-		filename := fmt.Sprintf("%s.conf", filenameRe.ReplaceAllString(client.Name, "_"))
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		w.Header().Set("Content-Type", "application/config")
-		w.WriteHeader(http.StatusOK)
-		_, err := fmt.Fprint(w, clientConfig)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		serveClientConfig(w, client, clientConfig)
 		return
 	}
 
@@ -647,22 +1150,31 @@ func (s *Server) GetClient(w http.ResponseWriter, r *http.Request, ps httprouter
 func (s *Server) EditClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	user := r.Context().Value(key).(string)
+	user := ps.ByName("user")
 	usercfg := s.Config.Users[user]
 	if usercfg == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	client := usercfg.Clients[ps.ByName("client")]
+	client := clientOf(usercfg, ps)
 	if client == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	cfg := ClientConfig{}
+	// sent holds the fields in the request, the client settings are left as they are unless sent
+	var sent map[string]json.RawMessage
 
-	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &cfg)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &sent)
+	}
+	if err != nil {
 		log.Warn("Error parsing request: ", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -670,6 +1182,72 @@ func (s *Server) EditClient(w http.ResponseWriter, r *http.Request, ps httproute
 
 	log.Debugf("EditClient: %#v", cfg)
 
+	if err := verifyClientSettings(&cfg); err != nil {
+		log.WithField("user", user).Warn("Invalid client settings: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	// The ACL is left as is if none is sent
+	changeACL := cfg.ACL != nil && !aclEqual(cfg.ACL, client.ACL)
+	if changeACL {
+		if !isAdmin(r) {
+			log.WithField("user", user).Warn("Client ACL change requested by non-admin")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := verifyACL(cfg.ACL); err != nil {
+			log.WithField("user", user).Warn("Invalid client ACL: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+	}
+
+	// AllowedIPs are routed to the client and accepted as its source addresses, which would let it take the addresses
+	// of others and slip past its ACL
+	changeAllowedIPs := len(cfg.AllowedIPs) != 0 && !ipNetsEqual(cfg.AllowedIPs, client.AllowedIPs)
+	if changeAllowedIPs && !isAdmin(r) {
+		log.WithField("user", user).Warn("Client AllowedIPs change requested by non-admin")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// The expiry is left as is if none is sent, an empty one removes it
+	changeExpiry := hasField(sent, "ExpiresAt") && cfg.ExpiresAt != client.ExpiresAt
+	if changeExpiry {
+		if err := verifyExpiry(r, cfg.ExpiresAt, client.ExpiresAt); err != nil {
+			log.WithField("user", user).Warn("Error changing client expiry: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+	}
+
+	// Changing the addresses is the last step that can fail, the client is only changed once it succeeded
+	if !ipsEqual(cfg.IP, client.IP) || !ipsEqual(cfg.IPv6, client.IPv6) {
+		if !isAdmin(r) {
+			log.WithField("user", user).Warn("Static client IP requested by non-admin")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := s.networks[client.Network].changeIPs(client, cfg.IP, cfg.IPv6); err != nil {
+			log.WithField("user", user).Warn("Unable to change client IP: ", err)
+			writeIPError(w, err)
+			return
+		}
+	}
+
 	if cfg.Name != "" {
 		client.Name = cfg.Name
 	}
@@ -682,14 +1260,38 @@ func (s *Server) EditClient(w http.ResponseWriter, r *http.Request, ps httproute
 		client.MTU = cfg.MTU
 	}
 
-	client.PresharedKey = cfg.PresharedKey
+	if hasField(sent, "PresharedKey") {
+		client.PresharedKey = cfg.PresharedKey
+	}
+	if hasField(sent, "Routes") {
+		client.Routes = cfg.Routes
+	}
+	if hasField(sent, "DNS") {
+		client.DNS = cfg.DNS
+	}
+	if hasField(sent, "DNSSearch") {
+		client.DNSSearch = cfg.DNSSearch
+	}
+	if hasField(sent, "PersistentKeepalive") {
+		client.PersistentKeepalive = cfg.PersistentKeepalive
+	}
+
+	if changeExpiry {
+		client.ExpiresAt = cfg.ExpiresAt
+	}
+	if changeACL {
+		client.ACL = cfg.ACL
+	}
 
 	client.Modified = time.Now().Format(time.RFC3339)
 
-	if len(cfg.AllowedIPs) != 0 {
+	if changeAllowedIPs {
 		client.AllowedIPs = cfg.AllowedIPs
 	}
-	s.reconfigure()
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(client); err != nil {
@@ -699,11 +1301,66 @@ func (s *Server) EditClient(w http.ResponseWriter, r *http.Request, ps httproute
 	}
 }
 
+// ipNetsEqual returns whether two lists hold the same networks in the same order
+func ipNetsEqual(a []*net.IPNet, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil || a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// hasField returns whether a JSON object has a field, matching its name case-insensitively as encoding/json does
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipsEqual returns whether an address sent for a client is the one it has, treating a missing address as unchanged
+func ipsEqual(sent net.IP, current net.IP) bool {
+	return sent == nil || sent.Equal(current)
+}
+
+// changeIPs gives a client of the network the static addresses an admin chose, releasing the ones it had
+func (n *network) changeIPs(client *ClientConfig, ip net.IP, ipv6 net.IP) error {
+	if !ipsEqual(ip, client.IP) {
+		if err := n.assignIP(ip, false); err != nil {
+			return err
+		}
+	}
+	if !ipsEqual(ipv6, client.IPv6) {
+		if err := n.assignIP(ipv6, true); err != nil {
+			if !ipsEqual(ip, client.IP) {
+				n.allocator.cancel(ip)
+			}
+			return err
+		}
+	}
+
+	if !ipsEqual(ip, client.IP) {
+		n.allocator.Release(client.IP)
+		client.IP = ip
+	}
+	if !ipsEqual(ipv6, client.IPv6) {
+		n.allocator.Release(client.IPv6)
+		client.IPv6 = ipv6
+	}
+	return nil
+}
+
 // DeleteClient deletes the specified client for the current user
 func (s *Server) DeleteClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	user := r.Context().Value(key).(string)
+	user := ps.ByName("user")
 	usercfg := s.Config.Users[user]
 	if usercfg == nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -711,38 +1368,226 @@ func (s *Server) DeleteClient(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	client := ps.ByName("client")
-	if usercfg.Clients[client] == nil {
+	c := clientOf(usercfg, ps)
+	if c == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	s.networks[c.Network].allocator.Release(c.IP)
+	s.networks[c.Network].allocator.Release(c.IPv6)
 	delete(usercfg.Clients, client)
-	s.reconfigure()
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	log.WithField("user", user).Debug("Deleted client: ", client)
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// verifyPublicKey checks a public key provided for a client, whose key pair is kept on the client, and returns it in
+// the standard encoding, so that other encodings of the same key are not taken for a different one
+func (s *Server) verifyPublicKey(publicKey string) (string, error) {
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+	publicKey = key.String()
+	if s.Config.publicKeyInUse(publicKey) {
+		return "", fmt.Errorf("public key is already in use")
+	}
+	return publicKey, nil
+}
+
+// DisableClient removes the peer of the specified client without deleting the client
+func (s *Server) DisableClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.setClientDisabled(w, r, ps, true)
+}
+
+// EnableClient restores the peer of the specified client. Clients disabled by an admin can only be enabled by an admin.
+func (s *Server) EnableClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.setClientDisabled(w, r, ps, false)
+}
+
+func (s *Server) setClientDisabled(w http.ResponseWriter, r *http.Request, ps httprouter.Params, disabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := ps.ByName("user")
+	usercfg := s.Config.Users[user]
+	if usercfg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	client := clientOf(usercfg, ps)
+	if client == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	current := r.Context().Value(key).(string)
+	if !disabled && client.Disabled && client.DisabledBy != current && !isAdmin(r) {
+		log.WithField("user", current).WithField("path", r.URL.Path).Warn("Unauthorized attempt to enable client disabled by: ", client.DisabledBy)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	client.Disabled = disabled
+	client.DisabledBy = ""
+	if disabled {
+		client.DisabledBy = current
+	}
+	client.Modified = time.Now().Format(time.RFC3339)
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{"user": user, "client": ps.ByName("client"), "by": current}).Infof("Set client disabled: %t", disabled)
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(client); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// RotateClient replaces the keys of the specified client, keeping everything else. It returns the client, or its new
+// config file if the format query parameter is config.
+func (s *Server) RotateClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := ps.ByName("user")
+	usercfg := s.Config.Users[user]
+	if usercfg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	client := clientOf(usercfg, ps)
+	if client == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	req := struct {
+		PublicKey string
+		RotatePSK bool
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Warn("Error parsing request: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if client.PrivateKey == "" && req.PublicKey == "" {
+		log.Warn("No public key given to rotate client without private key: ", client.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.PublicKey != "" {
+		var err error
+		if req.PublicKey, err = s.verifyPublicKey(req.PublicKey); err != nil {
+			log.Warn("Invalid public key: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := client.RotateKeys(req.PublicKey, req.RotatePSK); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{"user": user, "client": ps.ByName("client"), "psk": req.RotatePSK}).Info("Rotated client keys")
+
+	if r.URL.Query().Get("format") == "config" {
+		n := s.networks[client.Network]
+		serveClientConfig(w, client, s.clientConfig(client, n, n.PublicKey))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(client); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseGroupMaxClients parses the group=number values of --group-max-clients. They are split at the last =, as groups
+// may be DNs like cn=contractors,ou=groups,dc=example,dc=com.
+func parseGroupMaxClients(values []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, v := range values {
+		i := strings.LastIndex(v, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --group-max-clients %s, expected group=number", v)
+		}
+		n, err := strconv.Atoi(v[i+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid --group-max-clients of %s: %s", v[:i], v[i+1:])
+		}
+		limits[v[:i]] = n
+	}
+	return limits, nil
+}
+
+// maxClients returns the max number of configs of a member of groups, 0 if unlimited
+func (s *Server) maxClients(groups []string) int {
+	max, found := 0, false
+	for _, g := range groups {
+		n, ok := s.groupMaxClients[g]
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			return 0
+		}
+		if n > max {
+			max = n
+		}
+		found = true
+	}
+	if !found {
+		return *maxNumberClientConfig
+	}
+	return max
+}
+
 // CreateClient creates a new client for the current user
 func (s *Server) CreateClient(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	user := r.Context().Value(key).(string)
+	user := ps.ByName("user")
 	log.WithField("user", user).Debug("CreateClient")
 
 	c := s.Config.GetUserConfig(user)
 	log.Debugf("user config: %#v", c)
 
-	if *maxNumberClientConfig > 0 {
-		if len(c.Clients) >= *maxNumberClientConfig {
+	groups := c.Groups
+	if r.Context().Value(key) == user {
+		groups, _ = r.Context().Value(groupsKey).([]string)
+	}
+	if max := s.maxClients(groups); max > 0 {
+		if len(c.Clients) >= max {
 			log.Error(fmt.Errorf("user %q have too many configs", c.Name))
 
 			e := struct {
 				Error string
 			}{
-				Error: "Max number of configs: " + strconv.Itoa(*maxNumberClientConfig),
+				Error: "Max number of configs: " + strconv.Itoa(max),
 			}
 
 			w.WriteHeader(http.StatusBadRequest)
@@ -770,6 +1615,39 @@ func (s *Server) CreateClient(w http.ResponseWriter, r *http.Request, ps httprou
 		newclient.Name = "Unnamed Client"
 	}
 
+	if newclient.ExpiresAt == "" && *clientDefaultLifetime != 0 {
+		newclient.ExpiresAt = time.Now().Add(*clientDefaultLifetime).Format(time.RFC3339)
+	}
+	if err := verifyExpiry(r, newclient.ExpiresAt, ""); err != nil {
+		log.WithField("user", user).Warn("Invalid new client expiry: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if err := verifyClientSettings(&newclient.ClientConfig); err != nil {
+		log.WithField("user", user).Warn("Invalid new client settings: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if err := verifyACL(newclient.ACL); err != nil {
+		log.WithField("user", user).Warn("Invalid new client ACL: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
 	if err := verifyLinkMTU(newclient.MTU); err != nil {
 		log.Debugf("Invalid new client MTU: %d", newclient.MTU)
 		if err := verifyLinkMTU(*wgPeerMtu); err != nil {
@@ -794,11 +1672,57 @@ func (s *Server) CreateClient(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 	i = i + 1
 
-	ip := s.allocateIP()
-	client := NewClientConfig(newclient.Name, ip, newclient.MTU, newclient.Notes, newclient.GeneratePSK)
+	if newclient.PublicKey != "" {
+		var err error
+		if newclient.PublicKey, err = s.verifyPublicKey(newclient.PublicKey); err != nil {
+			log.WithField("user", user).Warn("Invalid new client public key: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			err = json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+	}
+
+	if (newclient.IP != nil || newclient.IPv6 != nil) && !isAdmin(r) {
+		log.WithField("user", user).Warn("Static client IP requested by non-admin")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if len(newclient.ACL) > 0 && !isAdmin(r) {
+		log.WithField("user", user).Warn("Client ACL requested by non-admin")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Context().Value(key) == user {
+		c.Groups, _ = r.Context().Value(groupsKey).([]string)
+	}
+	n := s.networkOf(ps)
+	pool := s.Config.Pools[s.Config.poolFor(n.name, user, c.Groups)]
+
+	ip, ipv6, err := n.assignIPs(newclient.IP, newclient.IPv6, pool)
+	if err != nil {
+		log.WithField("user", user).Warn("Unable to allocate client IP: ", err)
+		writeIPError(w, err)
+		return
+	}
+
+	client := NewClientConfig(newclient.Name, ip, newclient.MTU, newclient.Notes, newclient.GeneratePSK, newclient.PublicKey)
+	client.Network = n.name
+	client.IPv6 = ipv6
+	client.ExpiresAt = newclient.ExpiresAt
+	client.Routes = newclient.Routes
+	client.DNS = newclient.DNS
+	client.DNSSearch = newclient.DNSSearch
+	client.PersistentKeepalive = newclient.PersistentKeepalive
+	client.ACL = newclient.ACL
 	c.Clients[strconv.Itoa(i)] = client
 
-	s.reconfigure()
+	if err := s.reconfigure(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	err = json.NewEncoder(w).Encode(client)
 	if err != nil {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionCookie is the cookie holding the session of a user logged in by wg-ui itself
+	sessionCookie = "wgsession"
+	// csrfHeader carries the CSRF token of the session in requests changing clients
+	csrfHeader = "X-CSRF-Token"
+)
+
+var errInvalidSession = errors.New("invalid session")
+
+// session is the identity of a logged in user, kept in a cookie signed by the server
+type session struct {
+	// ID tells sessions of the same user apart, so that each has its own CSRF token
+	ID      string
+	User    string
+	Groups  []string `json:",omitempty"`
+	Expires int64
+}
+
+// newSessionKey returns the key signing session cookies: --session-key, or a random one if it is empty, in which case
+// users have to log in again whenever the server restarts
+func newSessionKey() []byte {
+	if *sessionKey != "" {
+		return []byte(*sessionKey)
+	}
+
+	log.Info("No --session-key given, sessions end when the server restarts")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.WithError(err).Fatal("Error generating session key")
+	}
+	return key
+}
+
+// sign returns value followed by its signature
+func (s *Server) sign(value []byte) string {
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write(value)
+	return base64.RawURLEncoding.EncodeToString(value) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the value of a string returned by sign, if its signature is valid
+func (s *Server) verify(signed string) ([]byte, error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return nil, errInvalidSession
+	}
+	value, err := base64.RawURLEncoding.DecodeString(signed[:i])
+	if err != nil {
+		return nil, errInvalidSession
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write(value)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidSession
+	}
+	return value, nil
+}
+
+// setSignedCookie sets a cookie holding a signed JSON value, readable by the server only, until expires
+func (s *Server) setSignedCookie(w http.ResponseWriter, r *http.Request, name string, v interface{}, expires time.Time) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    s.sign(value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// isHTTPS returns whether the request was made over HTTPS, to wg-ui or to a proxy in front of it. X-Forwarded-Proto is
+// only believed from a proxy accepted by --trusted-proxies, --proxy-secret or --proxy-client-ca, anyone else could set
+// it.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return s.proxy != nil && s.proxy.required() && s.proxy.trusted(r) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// signedCookie reads a cookie set by setSignedCookie into v
+func (s *Server) signedCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	value, err := s.verify(cookie.Value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// startSession logs a user in, for --session-lifetime
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user string, groups []string) error {
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(*sessionLifetime)
+	return s.setSignedCookie(w, r, sessionCookie, session{ID: id, User: user, Groups: groups, Expires: expires.Unix()}, expires)
+}
+
+// sessionOf returns the session of the request, if it has one that has not expired
+func (s *Server) sessionOf(r *http.Request) (*session, error) {
+	var sess session
+	if err := s.signedCookie(r, sessionCookie, &sess); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= sess.Expires || s.isRevoked(sess.ID) {
+		return nil, errInvalidSession
+	}
+	return &sess, nil
+}
+
+// revoke ends sess before it expires, so that copies of its cookie are no longer accepted either. Revocations are kept
+// in memory only, with --session-key set sessions logged out of are valid again after a restart.
+func (s *Server) revoke(sess *session) {
+	s.revokedMux.Lock()
+	defer s.revokedMux.Unlock()
+	if s.revoked == nil {
+		s.revoked = make(map[string]int64)
+	}
+	now := time.Now().Unix()
+	for id, expires := range s.revoked {
+		if now >= expires {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[sess.ID] = sess.Expires
+}
+
+// isRevoked returns whether the session with the given ID was logged out of
+func (s *Server) isRevoked(id string) bool {
+	s.revokedMux.Lock()
+	defer s.revokedMux.Unlock()
+	_, ok := s.revoked[id]
+	return ok
+}
+
+// csrfToken returns the token requests of the user changing clients must carry in the X-CSRF-Token header. It is
+// bound to the session if the user logged in with wg-ui, or else to the user identified by the proxy.
+func (s *Server) csrfToken(r *http.Request) string {
+	user, _ := r.Context().Value(key).(string)
+	var id string
+	if sess, ok := r.Context().Value(sessionCtxKey).(*session); ok {
+		id = sess.ID
+	}
+
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte("csrf\x00" + user + "\x00" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withCSRF answers requests without the CSRF token of the user with 403 Forbidden
+func (s *Server) withCSRF(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(s.csrfToken(r))) != 1 {
+			log.WithField("user", r.Context().Value(key)).WithField("path", r.URL.Path).Warn("Request without valid CSRF token")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, r, ps)
+	}
+}
+
+// GetSession returns the identity of the current user, when the session expires, if it was started by wg-ui, and the
+// CSRF token to send along with changes
+func (s *Server) GetSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := r.Context().Value(key).(string)
+	groups, _ := r.Context().Value(groupsKey).([]string)
+	var expires string
+	if sess, ok := r.Context().Value(sessionCtxKey).(*session); ok {
+		expires = time.Unix(sess.Expires, 0).UTC().Format(time.RFC3339)
+	}
+
+	err := json.NewEncoder(w).Encode(struct {
+		User      string
+		Admin     bool
+		Groups    []string
+		Expires   string `json:",omitempty"`
+		CSRFToken string
+	}{user, isAdmin(r), groups, expires, s.csrfToken(r)})
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// DeleteSession logs the current user out, revoking their session. Users identified by the proxy stay logged in with
+// it.
+func (s *Server) DeleteSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sess, ok := r.Context().Value(sessionCtxKey).(*session); ok {
+		s.revoke(sess)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	log.WithField("user", r.Context().Value(key)).Info("Logged out")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerOnlineTimeout is how long after its last handshake a peer is considered online. WireGuard renews the session
+// every two minutes while there is traffic.
+const peerOnlineTimeout = 3 * time.Minute
+
+// clientStatus is the state of the WireGuard peer of a client
+type clientStatus struct {
+	Network string
+	Online  bool
+	// LastHandshake is empty if the client never connected since the device was set up
+	LastHandshake string
+	Endpoint      string
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// peers returns the WireGuard peers of all networks by public key
+func (s *Server) peers() (map[string]wgtypes.Peer, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wg.Close()
+
+	peers := make(map[string]wgtypes.Peer)
+	for _, n := range s.sortedNetworks() {
+		dev, err := wg.Device(n.Device)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range dev.Peers {
+			peers[peer.PublicKey.String()] = peer
+		}
+	}
+	return peers, nil
+}
+
+// newClientStatus returns the status of a client from its peer, which it lacks while disabled or expired
+func newClientStatus(client *ClientConfig, peers map[string]wgtypes.Peer, now time.Time) clientStatus {
+	status := clientStatus{Network: client.Network}
+	peer, ok := peers[client.PublicKey]
+	if !ok {
+		return status
+	}
+
+	if !peer.LastHandshakeTime.IsZero() {
+		status.LastHandshake = peer.LastHandshakeTime.Format(time.RFC3339)
+		status.Online = now.Sub(peer.LastHandshakeTime) < peerOnlineTimeout
+	}
+	if peer.Endpoint != nil {
+		status.Endpoint = peer.Endpoint.String()
+	}
+	status.ReceiveBytes = peer.ReceiveBytes
+	status.TransmitBytes = peer.TransmitBytes
+	return status
+}
+
+// GetClientStatus returns the status of the WireGuard peer of a client
+func (s *Server) GetClientStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	usercfg := s.Config.Users[ps.ByName("user")]
+	if usercfg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	client := clientOf(usercfg, ps)
+	if client == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	peers, err := s.peers()
+	if err != nil {
+		log.Error("Error reading WireGuard peers: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(newClientStatus(client, peers, time.Now()))
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// GetClientsStatus returns the status of the WireGuard peers of all clients of a user, by client
+func (s *Server) GetClientsStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	peers, err := s.peers()
+	if err != nil {
+		log.Error("Error reading WireGuard peers: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	statuses := map[string]clientStatus{}
+	if usercfg := s.Config.Users[ps.ByName("user")]; usercfg != nil {
+		for id, client := range usercfg.Clients {
+			if ps.ByName("net") == "" || client.Network == ps.ByName("net") {
+				statuses[id] = newClientStatus(client, peers, now)
+			}
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
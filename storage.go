@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage persists a ServerConfig
+type Storage interface {
+	// Load reads the stored config into cfg. An error satisfying os.IsNotExist is returned when nothing is stored yet.
+	Load(cfg *ServerConfig) error
+	// Save persists cfg
+	Save(cfg *ServerConfig) error
+	// Close releases any resources held by the storage
+	Close() error
+}
+
+// newStorage opens the storage of the given kind inside dir
+func newStorage(kind string, dir string) (Storage, error) {
+	switch kind {
+	case "json":
+		return &jsonStorage{path: path.Join(dir, "config.json")}, nil
+	case "bolt":
+		return newBoltStorage(path.Join(dir, "config.db"))
+	case "dir":
+		return newDirStorage(dir)
+	default:
+		return nil, fmt.Errorf("unknown storage: %s", kind)
+	}
+}
+
+// marshalServerMeta marshals everything in cfg except the users, which record based storages keep separately
+func marshalServerMeta(cfg *ServerConfig) ([]byte, error) {
+	meta := *cfg
+	meta.Users = nil
+	return json.MarshalIndent(&meta, "", " ")
+}
+
+// jsonStorage keeps the whole config in a single JSON file
+type jsonStorage struct {
+	path string
+}
+
+func (s *jsonStorage) Load(cfg *ServerConfig) error {
+	f, err := os.Open(filepath.Clean(s.path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return fmt.Errorf("decode %s: %w", s.path, err)
+	}
+	log.Debug("Read server config from file: ", s.path)
+	return nil
+}
+
+func (s *jsonStorage) Save(cfg *ServerConfig) error {
+	data, err := json.MarshalIndent(cfg, "", " ")
+	if err != nil {
+		return err
+	}
+
+	if *configBackups <= 0 {
+		return writeFileAtomic(s.path, data, 0600)
+	}
+
+	if err := backupFile(s.path); err != nil {
+		return fmt.Errorf("backup %s: %w", s.path, err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	return pruneBackups(s.path, *configBackups)
+}
+
+func (s *jsonStorage) Close() error {
+	return nil
+}
+
+var (
+	boltServerBucket = []byte("server")
+	boltUsersBucket  = []byte("users")
+	boltServerKey    = []byte("config")
+)
+
+// boltStorage keeps the server settings and every user as separate records in a bbolt database
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func newBoltStorage(dbPath string) (*boltStorage, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dbPath, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltServerBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Debug("Opened bolt storage: ", dbPath)
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Load(cfg *ServerConfig) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltServerBucket).Get(boltServerKey)
+		if meta == nil {
+			return os.ErrNotExist
+		}
+		if err := json.Unmarshal(meta, cfg); err != nil {
+			return fmt.Errorf("decode server config: %w", err)
+		}
+
+		cfg.Users = make(map[string]*UserConfig)
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			user := &UserConfig{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return fmt.Errorf("decode user %s: %w", k, err)
+			}
+			cfg.Users[string(k)] = user
+			return nil
+		})
+	})
+}
+
+func (s *boltStorage) Save(cfg *ServerConfig) error {
+	meta, err := marshalServerMeta(cfg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltServerBucket).Put(boltServerKey, meta); err != nil {
+			return err
+		}
+
+		users := tx.Bucket(boltUsersBucket)
+		for name, user := range cfg.Users {
+			data, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			// Only touch the records which actually changed
+			if bytes.Equal(users.Get([]byte(name)), data) {
+				continue
+			}
+			if err := users.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+
+		var removed [][]byte
+		err := users.ForEach(func(k, _ []byte) error {
+			if _, ok := cfg.Users[string(k)]; !ok {
+				removed = append(removed, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range removed {
+			if err := users.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+// dirStorage keeps the server settings in server.json and every user in a file of its own below users/
+type dirStorage struct {
+	dir     string
+	written map[string][]byte
+}
+
+func newDirStorage(dir string) (*dirStorage, error) {
+	if err := os.MkdirAll(path.Join(dir, "users"), 0700); err != nil {
+		return nil, err
+	}
+	return &dirStorage{
+		dir:     dir,
+		written: make(map[string][]byte),
+	}, nil
+}
+
+func (s *dirStorage) userPath(name string) string {
+	return path.Join(s.dir, "users", url.PathEscape(name)+".json")
+}
+
+func (s *dirStorage) Load(cfg *ServerConfig) error {
+	meta, err := ioutil.ReadFile(path.Join(s.dir, "server.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(meta, cfg); err != nil {
+		return fmt.Errorf("decode server.json: %w", err)
+	}
+
+	files, err := filepath.Glob(path.Join(s.dir, "users", "*.json"))
+	if err != nil {
+		return err
+	}
+
+	cfg.Users = make(map[string]*UserConfig)
+	for _, file := range files {
+		name, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			log.WithError(err).Warn("Skipping user file with invalid name: ", file)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Clean(file))
+		if err != nil {
+			return err
+		}
+		user := &UserConfig{}
+		if err := json.Unmarshal(data, user); err != nil {
+			return fmt.Errorf("decode %s: %w", file, err)
+		}
+		cfg.Users[name] = user
+		s.written[name] = data
+	}
+
+	log.Debug("Read server config from directory: ", s.dir)
+	return nil
+}
+
+func (s *dirStorage) Save(cfg *ServerConfig) error {
+	meta, err := marshalServerMeta(cfg)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path.Join(s.dir, "server.json"), meta, 0600); err != nil {
+		return err
+	}
+
+	for name, user := range cfg.Users {
+		data, err := json.MarshalIndent(user, "", " ")
+		if err != nil {
+			return err
+		}
+		// Only rewrite the files which actually changed
+		if bytes.Equal(s.written[name], data) {
+			continue
+		}
+		if err := writeFileAtomic(s.userPath(name), data, 0600); err != nil {
+			return err
+		}
+		s.written[name] = data
+	}
+
+	for name := range s.written {
+		if _, ok := cfg.Users[name]; ok {
+			continue
+		}
+		if err := os.Remove(s.userPath(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.written, name)
+	}
+	return nil
+}
+
+func (s *dirStorage) Close() error {
+	return nil
+}
+
+// importJSONConfig copies the config.json at jsonPath into an empty storage, easing the switch away from the JSON storage
+func importJSONConfig(storage Storage, jsonPath string) error {
+	err := storage.Load(&ServerConfig{})
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	cfg := &ServerConfig{}
+	err = (&jsonStorage{path: jsonPath}).Load(cfg)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Info("Importing existing config from: ", jsonPath)
+	return storage.Save(cfg)
+}
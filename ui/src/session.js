@@ -0,0 +1,24 @@
+let session;
+
+// getSession returns the session of the current user, fetched once
+export function getSession() {
+  if (!session) {
+    session = fetch("/api/v1/session").then(res => res.json());
+  }
+  return session;
+}
+
+// csrfHeaders adds the CSRF token of the session to the headers of a request changing clients
+export async function csrfHeaders(headers = {}) {
+  const s = await getSession();
+  return Object.assign({}, headers, { "X-CSRF-Token": s.CSRFToken });
+}
+
+// logout ends the session and reloads the page, sending the user to log in again
+export async function logout() {
+  await fetch("/api/v1/session", {
+    method: "DELETE",
+    headers: await csrfHeaders(),
+  });
+  window.location.assign("/");
+}